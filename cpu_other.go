@@ -0,0 +1,12 @@
+// cpu_other.go
+// Copyright (c) 2019 Red Hat Inc.
+
+//go:build windows
+
+package main
+
+// processCPUNano -- CPU accounting isn't available here, so the client CPU
+// cost is always reported as 0
+func processCPUNano() int64 {
+	return 0
+}
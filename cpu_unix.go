@@ -0,0 +1,19 @@
+// cpu_unix.go
+// Copyright (c) 2019 Red Hat Inc.
+
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// processCPUNano -- user plus system CPU time used by hsbench so far
+func processCPUNano() int64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return ru.Utime.Nano() + ru.Stime.Nano()
+}
@@ -0,0 +1,149 @@
+// driver.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Driver is the storage backend the benchmark modes run against.  All the
+// threads of a test share one Driver, so implementations have to be safe
+// for concurrent use.
+type Driver interface {
+	// CreateBucket succeeds if the bucket already exists
+	CreateBucket(ctx context.Context, bucket string) error
+	DeleteBucket(ctx context.Context, bucket string) error
+	// PutObject returns the version ID of the new object, if any
+	PutObject(ctx context.Context, bucket string, key string, data []byte) (string, error)
+	// GetObject returns once the response headers are in, the caller reads
+	// and closes the body.  An empty versionId reads the latest version.
+	GetObject(ctx context.Context, bucket string, key string, versionId string) (io.ReadCloser, error)
+	// HeadObject returns the size of the object.  Missing objects have to
+	// be reported with an error isNotFound recognizes.
+	HeadObject(ctx context.Context, bucket string, key string) (int64, error)
+	DeleteObject(ctx context.Context, bucket string, key string, versionId string) error
+	// DeleteObjects returns how many of the objects were actually removed
+	DeleteObjects(ctx context.Context, bucket string, objects []ObjectId) (int, error)
+	// List calls page for every page of the listing until it returns false
+	List(ctx context.Context, bucket string, opts ListOptions, page func(ListPage) bool) error
+}
+
+// Copier -- a Driver that can copy objects without moving the data through
+// the client, needed by the "y" mode.  size is the size of the source.
+type Copier interface {
+	CopyObject(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, size int64) error
+}
+
+// Versioner -- a Driver with object versioning, needed by -ver and the
+// "v", "r", "o" and "k" modes
+type Versioner interface {
+	EnableVersioning(ctx context.Context, bucket string) error
+	IsVersioned(ctx context.Context, bucket string) (bool, error)
+}
+
+// UploadAborter -- a Driver that can be left with incomplete multipart
+// uploads, which bucket clears and deletes clean up
+type UploadAborter interface {
+	ListUploads(ctx context.Context, bucket string, prefix string, upload func(key string, uploadId string) bool) error
+	AbortUpload(ctx context.Context, bucket string, key string, uploadId string) error
+}
+
+// ObjectId -- an object, or one version of it
+type ObjectId struct {
+	Key       string
+	VersionId string
+	Size      int64
+}
+
+type ListOptions struct {
+	Prefix     string
+	Delimiter  string
+	StartAfter string
+	MaxKeys    int64
+	// ListObjects API version, for drivers that have more than one
+	Version int
+	// List every version and delete marker instead of the objects
+	Versions bool
+}
+
+type ListPage struct {
+	Objects  []ObjectId
+	Prefixes []string
+}
+
+// The driver every test runs against, set up by main
+var backend Driver
+
+// makeDriver -- build the driver selected with -u and -driver
+func makeDriver() Driver {
+	if driver == "file" {
+		return makeFileDriver(strings.TrimPrefix(url_host, "file://"))
+	}
+	cfg := &aws.Config{
+		Endpoint:    aws.String(url_host),
+		Credentials: credentials.NewStaticCredentials(access_key, secret_key, ""),
+		Region:      aws.String(region),
+		// DisableParamValidation:  aws.Bool(true),
+		DisableComputeChecksums: aws.Bool(true),
+		S3ForcePathStyle:        aws.Bool(true),
+		// Failed requests are retried by opContext.try, so that every
+		// failure shows up in the results
+		MaxRetries: aws.Int(0),
+	}
+	sdk := makeSDKDriver(cfg)
+	if driver == "raw" {
+		return &rawDriver{sdk}
+	}
+	return sdk
+}
+
+// isNotFound -- whether a driver error means the object doesn't exist
+func isNotFound(err error) bool {
+	if reqerr, ok := err.(awserr.RequestFailure); ok {
+		return reqerr.StatusCode() == http.StatusNotFound
+	}
+	return os.IsNotExist(err)
+}
+
+// retryable -- whether a failed request is worth sending again, i.e. it
+// timed out, lost its connection, was throttled or hit a server error.
+// ctx is the context the request was sent with.
+func retryable(ctx context.Context, err error) bool {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return true
+	case context.Canceled:
+		// The run is over, not the request
+		return false
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case awserr.RequestFailure:
+			if e.StatusCode() != 0 {
+				return e.StatusCode() >= 500 || e.StatusCode() == http.StatusTooManyRequests || e.Code() == "SlowDown"
+			}
+			err = e.OrigErr()
+		case awserr.Error:
+			err = e.OrigErr()
+		case net.Error:
+			return true
+		default:
+			// A body cut short by the connection going away
+			if err == io.ErrUnexpectedEOF {
+				return true
+			}
+			err = errors.Unwrap(err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// driver_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	refused := &url.Error{Op: "Put", URL: "http://localhost", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&rawError{status: 500, code: "InternalError"}, true},
+		{&rawError{status: 503, code: "SlowDown"}, true},
+		{&rawError{status: 429}, true},
+		{&rawError{status: 404, code: "NoSuchBucket"}, false},
+		{&rawError{status: 403, code: "AccessDenied"}, false},
+		{&rawError{status: 400, code: "InvalidArgument"}, false},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), true},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, ""), false},
+		{awserr.New("RequestError", "send request failed", refused), true},
+		{refused, true},
+		{io.ErrUnexpectedEOF, true},
+		{os.ErrNotExist, false},
+		{errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(context.Background(), tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if !retryable(ctx, refused) {
+		t.Errorf("a request that timed out isn't retried")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if retryable(ctx, refused) {
+		t.Errorf("a request cancelled at the end of the run is retried")
+	}
+}
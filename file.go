@@ -0,0 +1,266 @@
+// file.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// File driver settings, see -fsync and -odirect
+var file_fsync, file_odirect bool
+
+// O_DIRECT needs buffers, offsets and sizes aligned to the logical block
+// size of the device.  4K covers every device in common use.
+const directAlign = 4096
+
+// alignedBuffer -- a zeroed buffer starting on a directAlign boundary
+func alignedBuffer(size int64) []byte {
+	b := make([]byte, size+directAlign)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % directAlign); rem != 0 {
+		off = directAlign - rem
+	}
+	return b[off : int64(off)+size : int64(off)+size]
+}
+
+// Aligned read buffers for O_DIRECT GETs
+var directBufPool = sync.Pool{
+	New: func() interface{} {
+		b := alignedBuffer(1024 * 1024)
+		return &b
+	},
+}
+
+// directReader -- an O_DIRECT file that reads itself into aligned buffers
+// when drained with io.Copy
+type directReader struct {
+	*os.File
+}
+
+func (r directReader) WriteTo(w io.Writer) (int64, error) {
+	buf := directBufPool.Get().(*[]byte)
+	defer directBufPool.Put(buf)
+	total := int64(0)
+	for {
+		n, err := r.File.Read(*buf)
+		if n > 0 {
+			if _, werr := w.Write((*buf)[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// fileDriver -- a Driver for POSIX filesystems, selected with a file://
+// URL.  Buckets are directories under root and objects are files in them,
+// with every "/" in a key making a subdirectory.
+type fileDriver struct {
+	root string
+}
+
+func makeFileDriver(root string) *fileDriver {
+	if st, err := os.Stat(root); err != nil || !st.IsDir() {
+		log.Fatalf("FATAL: The file driver root %s is not a directory", root)
+	}
+	return &fileDriver{root: root}
+}
+
+func (d *fileDriver) path(bucket string, key string) string {
+	return filepath.Join(d.root, bucket, filepath.FromSlash(key))
+}
+
+func (d *fileDriver) CreateBucket(ctx context.Context, bucket string) error {
+	return os.MkdirAll(filepath.Join(d.root, bucket), 0755)
+}
+
+func (d *fileDriver) DeleteBucket(ctx context.Context, bucket string) error {
+	return os.Remove(filepath.Join(d.root, bucket))
+}
+
+// openFlags -- add O_DIRECT when asked for
+func openFlags(flags int) int {
+	if file_odirect {
+		flags |= oDirect
+	}
+	return flags
+}
+
+func (d *fileDriver) PutObject(ctx context.Context, bucket string, key string, data []byte) (string, error) {
+	p := d.path(bucket, key)
+	f, err := os.OpenFile(p, openFlags(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0644)
+	if os.IsNotExist(err) {
+		// The first object under a prefix creates its directories
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+			f, err = os.OpenFile(p, openFlags(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0644)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(data); err == nil && file_fsync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return "", err
+}
+
+func (d *fileDriver) GetObject(ctx context.Context, bucket string, key string, versionId string) (io.ReadCloser, error) {
+	f, err := os.OpenFile(d.path(bucket, key), openFlags(os.O_RDONLY), 0)
+	if err != nil {
+		return nil, err
+	}
+	if file_odirect {
+		return directReader{f}, nil
+	}
+	return f, nil
+}
+
+func (d *fileDriver) HeadObject(ctx context.Context, bucket string, key string) (int64, error) {
+	st, err := os.Stat(d.path(bucket, key))
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// DeleteObject -- remove the file and any directories left empty by it, so
+// that buckets can be deleted again.  Like S3, removing a missing object
+// isn't an error.
+func (d *fileDriver) DeleteObject(ctx context.Context, bucket string, key string, versionId string) error {
+	p := d.path(bucket, key)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	top := filepath.Join(d.root, bucket)
+	for dir := filepath.Dir(p); dir != top && strings.HasPrefix(dir, top); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *fileDriver) DeleteObjects(ctx context.Context, bucket string, objects []ObjectId) (int, error) {
+	for n, o := range objects {
+		if err := d.DeleteObject(ctx, bucket, o.Key, ""); err != nil {
+			return n, err
+		}
+	}
+	return len(objects), nil
+}
+
+// List -- walk the bucket below the prefix and hand out the keys in pages
+// of MaxKeys the way an S3 listing would.  The walk happens up front, so
+// it is part of the latency of the first page.
+func (d *fileDriver) List(ctx context.Context, bucket string, opts ListOptions, page func(ListPage) bool) error {
+	if opts.Versions {
+		return fmt.Errorf("the file driver doesn't support versioning")
+	}
+	top := filepath.Join(d.root, bucket)
+	// Only walk the directory the prefix points into
+	start := top
+	if i := strings.LastIndex(opts.Prefix, "/"); i >= 0 {
+		start = filepath.Join(top, filepath.FromSlash(opts.Prefix[:i]))
+	}
+	var objects []ObjectId
+	err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == start && start != top {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(top, p)
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.StartAfter {
+			objects = append(objects, ObjectId{Key: key, Size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Directory order isn't the byte order S3 lists keys in
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	max := int(opts.MaxKeys)
+	if max < 1 {
+		max = 1000
+	}
+	var p ListPage
+	lastPrefix := ""
+	for _, o := range objects {
+		if opts.Delimiter != "" {
+			if i := strings.Index(o.Key[len(opts.Prefix):], opts.Delimiter); i >= 0 {
+				cp := o.Key[:len(opts.Prefix)+i+len(opts.Delimiter)]
+				if cp == lastPrefix {
+					continue
+				}
+				lastPrefix = cp
+				p.Prefixes = append(p.Prefixes, cp)
+			} else {
+				p.Objects = append(p.Objects, o)
+			}
+		} else {
+			p.Objects = append(p.Objects, o)
+		}
+		if len(p.Objects)+len(p.Prefixes) == max {
+			if !page(p) {
+				return nil
+			}
+			p = ListPage{}
+		}
+	}
+	// Like S3, an empty listing still returns one page
+	if len(p.Objects)+len(p.Prefixes) > 0 || len(objects) == 0 {
+		page(p)
+	}
+	return nil
+}
+
+func (d *fileDriver) CopyObject(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, size int64) error {
+	src, err := os.Open(d.path(srcBucket, srcKey))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	p := d.path(dstBucket, dstKey)
+	dst, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+			dst, err = os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err == nil && file_fsync {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
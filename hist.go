@@ -0,0 +1,109 @@
+// hist.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"math/bits"
+)
+
+// Number of buckets for every power of two of a latHist, which keeps the
+// error of a recorded latency under 1/histSub
+const histSub = 64
+
+// latHist -- a log-linear histogram of latencies in nanoseconds.  It takes
+// the place of the latNano slices where those would grow without bound.
+type latHist struct {
+	counts []int64
+	n      int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+func makeLatHist() *latHist {
+	return &latHist{}
+}
+
+// histIndex -- the bucket of latency v
+func histIndex(v int64) int {
+	if v < 2*histSub {
+		return int(v)
+	}
+	e := bits.Len64(uint64(v)) - bits.Len64(2*histSub-1)
+	return e*histSub + int(v>>uint(e))
+}
+
+// histValue -- the smallest latency in bucket i
+func histValue(i int) int64 {
+	if i < 2*histSub {
+		return int64(i)
+	}
+	e := i/histSub - 1
+	return int64(i%histSub+histSub) << uint(e)
+}
+
+func (h *latHist) add(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := histIndex(v)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.n == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.n++
+	h.sum += v
+}
+
+func (h *latHist) merge(o *latHist) {
+	if o == nil || o.n == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]int64, len(o.counts)-len(h.counts))...)
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.n == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.n += o.n
+	h.sum += o.sum
+}
+
+// quantile -- the latency that q of the recorded ones don't exceed, taken
+// as the middle of its bucket
+func (h *latHist) quantile(q float64) int64 {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			v := (histValue(i) + histValue(i+1)) / 2
+			if v < h.min {
+				v = h.min
+			}
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,63 @@
+// hist_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"testing"
+)
+
+// TestHistBuckets -- every latency falls in the bucket histValue says it
+// starts at, and no bucket is wider than 1/histSub of what it holds
+func TestHistBuckets(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 129, 255, 256, 1000, 123456789, 1 << 40} {
+		i := histIndex(v)
+		if lo, hi := histValue(i), histValue(i+1); v < lo || v >= hi {
+			t.Errorf("%d is in bucket %d, which holds %d to %d", v, i, lo, hi)
+		}
+	}
+	for i := 0; i < 40*histSub; i++ {
+		lo, hi := histValue(i), histValue(i+1)
+		if histIndex(lo) != i {
+			t.Fatalf("histIndex(histValue(%d)) = %d", i, histIndex(lo))
+		}
+		if hi <= lo || (hi-lo)*histSub > lo && hi-lo > 1 {
+			t.Fatalf("bucket %d holds %d to %d", i, lo, hi)
+		}
+	}
+}
+
+func TestHistQuantile(t *testing.T) {
+	h := makeLatHist()
+	if h.quantile(0.5) != 0 {
+		t.Errorf("an empty histogram has a median of %d", h.quantile(0.5))
+	}
+	for v := int64(1); v <= 10000; v++ {
+		h.add(v * 1000)
+	}
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99} {
+		want := q * 10000 * 1000
+		got := float64(h.quantile(q))
+		if got < want*(1-1.0/histSub) || got > want*(1+1.0/histSub) {
+			t.Errorf("quantile(%g) = %.0f, want %.0f", q, got, want)
+		}
+	}
+	// The middle of the last bucket is past the max
+	if min, max := h.quantile(0), h.quantile(1); min < 1000 || min > 1000+1000/histSub || max != 10000*1000 {
+		t.Errorf("the extremes are %d and %d, want about the min and the max", min, max)
+	}
+
+	// Merging two halves gives the same histogram as adding everything
+	a, b := makeLatHist(), makeLatHist()
+	for v := int64(1); v <= 10000; v++ {
+		if v%2 == 0 {
+			a.add(v * 1000)
+		} else {
+			b.add(v * 1000)
+		}
+	}
+	a.merge(b)
+	if a.n != h.n || a.sum != h.sum || a.min != h.min || a.max != h.max || a.quantile(0.9) != h.quantile(0.9) {
+		t.Errorf("the merged histogram differs from the whole one")
+	}
+}
@@ -5,10 +5,11 @@
 package main
 
 import (
-	"bytes"
 	"code.cloudfoundry.org/bytefmt"
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
+	crand "crypto/rand"
 	"crypto/sha1"
 	"crypto/tls"
 	"encoding/base64"
@@ -20,33 +21,55 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Global variables
 var access_key, secret_key, url_host, bucket_prefix, object_prefix, region, modes, output, json_output, sizeArg string
+var copy_dest, copy_key_select, copyPartSizeArg string
+var key_layout, key_template, key_client string
+var list_prefix, list_delimiter, list_start_after string
 var buckets []string
 var duration_secs, threads, loops int
 var object_data []byte
 var object_data_md5 string
-var max_keys, running_threads, bucket_count, object_count, object_size, op_counter int64
+var max_keys, running_threads, bucket_count, object_count, object_size, op_counter, pace_next int64
 var object_count_flag bool
 var endtime time.Time
 var interval float64
+var head_miss_ratio float64
+var copy_replace_metadata bool
+var copy_part_size int64
+var list_version, list_concurrency, list_random_prefix int
+var batch_delete_size int
+var key_depth, key_hash_len int
+var key_fanout, key_per_leaf int64
+var keygen KeyGen
 var zero_object_data bool
+var clear_all, clear_dry_run bool
+var versioning bool
+var versions_per_key int
+var sseCKeyArg string
+var request_timeout float64
+var sweepArg, searchArg, sloArg string
+var retries, max_errors int
+var warmup_secs, rampup_secs float64
+
+// Set to serve or proxy when hsbench is run with one of those subcommands
+var subcommand string
 
 // Our HTTP transport used for the roundtripper below
 var HTTPTransport http.RoundTripper = &http.Transport{
@@ -128,6 +151,9 @@ func setSignature(req *http.Request) {
 	req.Header.Set("X-Amz-Date", dateHdr)
 	// Get the canonical resource and header
 	canonicalResource := req.URL.EscapedPath()
+	if versionId := req.URL.Query().Get("versionId"); versionId != "" {
+		canonicalResource += "?versionId=" + versionId
+	}
 	canonicalHeaders := canonicalAmzHeaders(req)
 	stringToSign := req.Method + "\n" + req.Header.Get("Content-MD5") + "\n" + req.Header.Get("Content-Type") + "\n\n" +
 		canonicalHeaders + canonicalResource
@@ -141,9 +167,21 @@ type IntervalStats struct {
 	name         string
 	mode         string
 	bytes        int64
+	keys         int64
 	slowdowns    int64
 	intervalNano int64
 	latNano      []int64
+	// Takes the place of latNano in soak tests
+	hist *latHist
+}
+
+// soakHist -- a histogram for the latencies of an interval of a soak test,
+// nil otherwise
+func soakHist() *latHist {
+	if soak_prefix == "" {
+		return nil
+	}
+	return makeLatHist()
 }
 
 func (is *IntervalStats) makeOutputStats() OutputStats {
@@ -154,7 +192,18 @@ func (is *IntervalStats) makeOutputStats() OutputStats {
 	maxLat := float64(0)
 	NinetyNineLat := float64(0)
 	avgLat := float64(0)
-	if ops > 0 {
+	// The percentile of -slo, for -search
+	sloLat := float64(0)
+	if is.hist != nil {
+		ops = int(is.hist.n)
+	}
+	if is.hist != nil && ops > 0 {
+		minLat = float64(is.hist.min) / 1000000
+		maxLat = float64(is.hist.max) / 1000000
+		avgLat = float64(is.hist.sum) / float64(ops) / 1000000
+		NinetyNineLat = float64(is.hist.quantile(0.99)) / 1000000
+		sloLat = float64(is.hist.quantile(slo_percentile/100)) / 1000000
+	} else if ops > 0 {
 		minLat = float64(is.latNano[0]) / 1000000
 		maxLat = float64(is.latNano[ops-1]) / 1000000
 		for i := range is.latNano {
@@ -163,10 +212,14 @@ func (is *IntervalStats) makeOutputStats() OutputStats {
 		avgLat = float64(totalLat) / float64(ops) / 1000000
 		NintyNineLatNano := is.latNano[int64(math.Round(0.99*float64(ops)))-1]
 		NinetyNineLat = float64(NintyNineLatNano) / 1000000
+		if slo_percentile > 0 {
+			sloLat = float64(is.latNano[int64(math.Ceil(slo_percentile/100*float64(ops)))-1]) / 1000000
+		}
 	}
 	seconds := float64(is.intervalNano) / 1000000000
 	mbps := float64(is.bytes) / seconds / bytefmt.MEGABYTE
 	iops := float64(ops) / seconds
+	keysps := float64(is.keys) / seconds
 
 	return OutputStats{
 		is.loop,
@@ -180,7 +233,13 @@ func (is *IntervalStats) makeOutputStats() OutputStats {
 		avgLat,
 		NinetyNineLat,
 		maxLat,
-		is.slowdowns}
+		is.slowdowns,
+		is.keys,
+		keysps,
+		sse_mode,
+		0,
+		sweep_point,
+		sloLat}
 }
 
 type OutputStats struct {
@@ -196,11 +255,32 @@ type OutputStats struct {
 	NinetyNineLat float64
 	MaxLat        float64
 	Slowdowns     int64
+	Keys          int64
+	Keysps        float64
+	Encryption    string
+	CpuPerOp      float64
+	Sweep         string
+	sloLat        float64
 }
 
 func (o *OutputStats) log() {
+	// Only listing modes count keys, so leave them out of everything else
+	keys := ""
+	if o.Keys > 0 {
+		keys = fmt.Sprintf(", Keys: %d, Keys/s: %.0f", o.Keys, o.Keysps)
+	}
+	if o.Encryption != "" {
+		keys += ", SSE: " + o.Encryption
+	}
+	// Client CPU is only measured over a whole test
+	if o.CpuPerOp > 0 {
+		keys += fmt.Sprintf(", CPU(us/op): %.1f", o.CpuPerOp)
+	}
+	if o.Sweep != "" {
+		keys += ", Sweep: " + o.Sweep
+	}
 	log.Printf(
-		"Loop: %d, Int: %s, Dur(s): %.1f, Mode: %s, Ops: %d, MB/s: %.2f, IO/s: %.0f, Lat(ms): [ min: %.1f, avg: %.1f, 99%%: %.1f, max: %.1f ], Slowdowns: %d",
+		"Loop: %d, Int: %s, Dur(s): %.1f, Mode: %s, Ops: %d, MB/s: %.2f, IO/s: %.0f, Lat(ms): [ min: %.1f, avg: %.1f, 99%%: %.1f, max: %.1f ], Slowdowns: %d%s",
 		o.Loop,
 		o.IntervalName,
 		o.Seconds,
@@ -212,7 +292,8 @@ func (o *OutputStats) log() {
 		o.AvgLat,
 		o.NinetyNineLat,
 		o.MaxLat,
-		o.Slowdowns)
+		o.Slowdowns,
+		keys)
 }
 
 func (o *OutputStats) csv_header(w *csv.Writer) {
@@ -231,7 +312,12 @@ func (o *OutputStats) csv_header(w *csv.Writer) {
 		"Avg Latency(ms)",
 		"99% Latency(ms)",
 		"Max Latency(ms)",
-		"Slowdowns"}
+		"Slowdowns",
+		"Keys",
+		"Keys/s",
+		"Encryption",
+		"CPU(us)/op",
+		"Sweep"}
 
 	if err := w.Write(s); err != nil {
 		log.Fatal("Error writing to CSV writer: ", err)
@@ -255,7 +341,12 @@ func (o *OutputStats) csv(w *csv.Writer) {
 		strconv.FormatFloat(o.AvgLat, 'f', 2, 64),
 		strconv.FormatFloat(o.NinetyNineLat, 'f', 2, 64),
 		strconv.FormatFloat(o.MaxLat, 'f', 2, 64),
-		strconv.FormatInt(o.Slowdowns, 10)}
+		strconv.FormatInt(o.Slowdowns, 10),
+		strconv.FormatInt(o.Keys, 10),
+		strconv.FormatFloat(o.Keysps, 'f', 2, 64),
+		o.Encryption,
+		strconv.FormatFloat(o.CpuPerOp, 'f', 2, 64),
+		o.Sweep}
 
 	if err := w.Write(s); err != nil {
 		log.Fatal("Error writing to CSV writer: ", err)
@@ -270,7 +361,6 @@ func (o *OutputStats) json(jfile *os.File) {
 	if err != nil {
 		log.Fatal("Error marshaling JSON: ", err)
 	}
-	log.Println(string(jdata))
 	_, err = jfile.WriteString(string(jdata) + "\n")
 	if err != nil {
 		log.Fatal("Error writing to JSON file: ", err)
@@ -281,14 +371,23 @@ type ThreadStats struct {
 	start       int64
 	curInterval int64
 	intervals   []IntervalStats
+	// Ops finished before start, during the warm-up
+	warmup IntervalStats
+	// Number of intervals soak tests dropped from the front of intervals
+	base int64
 }
 
 func makeThreadStats(s int64, loop int, mode string, intervalNano int64) ThreadStats {
-	ts := ThreadStats{s, 0, []IntervalStats{}}
-	ts.intervals = append(ts.intervals, IntervalStats{loop, "0", mode, 0, 0, intervalNano, []int64{}})
+	ts := ThreadStats{s, 0, []IntervalStats{}, IntervalStats{loop, "WARMUP", mode, 0, 0, 0, 0, []int64{}, soakHist()}, 0}
+	ts.intervals = append(ts.intervals, IntervalStats{loop, "0", mode, 0, 0, 0, intervalNano, []int64{}, soakHist()})
 	return ts
 }
 
+// interval -- the stats of interval i
+func (ts *ThreadStats) interval(i int64) *IntervalStats {
+	return &ts.intervals[i-ts.base]
+}
+
 func (ts *ThreadStats) updateIntervals(loop int, mode string, intervalNano int64) int64 {
 	// Interval statistics disabled, so just return the current interval
 	if intervalNano < 0 {
@@ -304,8 +403,10 @@ func (ts *ThreadStats) updateIntervals(loop int, mode string, intervalNano int64
 				mode,
 				0,
 				0,
+				0,
 				intervalNano,
-				[]int64{}})
+				[]int64{},
+				soakHist()})
 	}
 	return ts.curInterval
 }
@@ -333,11 +434,18 @@ type Stats struct {
 	intervalCompletions sync.Map
 	// a counter of how many threads have finished updating stats entirely
 	completions int32
+	// Duration in nanoseconds of the warm-up before startNano
+	warmupNano int64
+	// What soak tests keep instead of the intervals, nil otherwise
+	soak *soakStats
 }
 
-func makeStats(loop int, mode string, threads int, intervalNano int64) Stats {
-	start := time.Now().UnixNano()
-	s := Stats{threads, loop, mode, start, 0, intervalNano, []ThreadStats{}, sync.Map{}, 0}
+func makeStats(loop int, mode string, threads int, intervalNano int64, warmupNano int64) Stats {
+	start := time.Now().UnixNano() + warmupNano
+	s := Stats{threads, loop, mode, start, 0, intervalNano, []ThreadStats{}, sync.Map{}, 0, warmupNano, nil}
+	if soak_prefix != "" {
+		s.soak = makeSoakStats(loop, mode)
+	}
 	for i := 0; i < threads; i++ {
 		s.threadStats = append(s.threadStats, makeThreadStats(start, s.loop, s.mode, s.intervalNano))
 		s.updateIntervals(i)
@@ -364,62 +472,100 @@ func (stats *Stats) makeOutputStats(i int64) (OutputStats, bool) {
 		return OutputStats{}, false
 	}
 
-	bytes := int64(0)
-	ops := int64(0)
-	slowdowns := int64(0)
-
-	for t := 0; t < stats.threads; t++ {
-		bytes += stats.threadStats[t].intervals[i].bytes
-		ops += int64(len(stats.threadStats[t].intervals[i].latNano))
-		slowdowns += stats.threadStats[t].intervals[i].slowdowns
+	parts := make([]*IntervalStats, stats.threads)
+	for t := range parts {
+		parts[t] = stats.threadStats[t].interval(i)
 	}
-	// Aggregate the per-thread Latency slice
-	tmpLat := make([]int64, ops)
-	var c int
-	for t := 0; t < stats.threads; t++ {
-		c += copy(tmpLat[c:], stats.threadStats[t].intervals[i].latNano)
-	}
-	sort.Slice(tmpLat, func(i, j int) bool { return tmpLat[i] < tmpLat[j] })
-	is := IntervalStats{stats.loop, strconv.FormatInt(i, 10), stats.mode, bytes, slowdowns, stats.intervalNano, tmpLat}
+	is := mergeIntervals(stats.loop, strconv.FormatInt(i, 10), stats.mode, parts, stats.intervalNano)
 	return is.makeOutputStats(), true
 }
 
 func (stats *Stats) makeTotalStats() (OutputStats, bool) {
 	// Not safe to log if not all writers have completed.
 	completions := atomic.LoadInt32(&stats.completions)
-	if completions < int32(threads) {
+	if completions < int32(stats.threads) {
 		log.Printf("log, completions: %d", completions)
 		return OutputStats{}, false
 	}
+	if stats.endNano <= stats.startNano {
+		log.Printf("%s ended during the warm-up, nothing was measured", stats.mode)
+		return OutputStats{}, false
+	}
 
+	// Soak tests only kept the intervals that weren't written out
+	parts := make([]*IntervalStats, 0)
+	if stats.soak != nil {
+		parts = append(parts, &stats.soak.total)
+	}
+	for t := 0; t < stats.threads; t++ {
+		for i := 0; i < len(stats.threadStats[t].intervals); i++ {
+			parts = append(parts, &stats.threadStats[t].intervals[i])
+		}
+	}
+	is := mergeIntervals(stats.loop, "TOTAL", stats.mode, parts, stats.endNano-stats.startNano)
+	return is.makeOutputStats(), true
+}
+
+// makeWarmupStats -- the stats of the ops that finished during the
+// warm-up, if there was one
+func (stats *Stats) makeWarmupStats() (OutputStats, bool) {
+	if stats.warmupNano <= 0 || atomic.LoadInt32(&stats.completions) < int32(stats.threads) {
+		return OutputStats{}, false
+	}
+	parts := make([]*IntervalStats, 0)
+	for t := 0; t < stats.threads; t++ {
+		parts = append(parts, &stats.threadStats[t].warmup)
+	}
+	nanos := stats.warmupNano
+	if stats.endNano < stats.startNano {
+		nanos -= stats.startNano - stats.endNano
+	}
+	is := mergeIntervals(stats.loop, "WARMUP", stats.mode, parts, nanos)
+	return is.makeOutputStats(), true
+}
+
+// mergeIntervals -- add up the intervals of several threads or points in
+// time into one that lasted nanos
+func mergeIntervals(loop int, name string, mode string, parts []*IntervalStats, nanos int64) IntervalStats {
 	bytes := int64(0)
+	keys := int64(0)
 	ops := int64(0)
 	slowdowns := int64(0)
 
-	for t := 0; t < stats.threads; t++ {
-		for i := 0; i < len(stats.threadStats[t].intervals); i++ {
-			bytes += stats.threadStats[t].intervals[i].bytes
-			ops += int64(len(stats.threadStats[t].intervals[i].latNano))
-			slowdowns += stats.threadStats[t].intervals[i].slowdowns
-		}
+	for _, p := range parts {
+		bytes += p.bytes
+		keys += p.keys
+		ops += int64(len(p.latNano))
+		slowdowns += p.slowdowns
 	}
 	// Aggregate the per-thread Latency slice
 	tmpLat := make([]int64, ops)
 	var c int
-	for t := 0; t < stats.threads; t++ {
-		for i := 0; i < len(stats.threadStats[t].intervals); i++ {
-			c += copy(tmpLat[c:], stats.threadStats[t].intervals[i].latNano)
-		}
+	for _, p := range parts {
+		c += copy(tmpLat[c:], p.latNano)
 	}
 	sort.Slice(tmpLat, func(i, j int) bool { return tmpLat[i] < tmpLat[j] })
-	is := IntervalStats{stats.loop, "TOTAL", stats.mode, bytes, slowdowns, stats.endNano - stats.startNano, tmpLat}
-	return is.makeOutputStats(), true
+	var hist *latHist
+	for _, p := range parts {
+		if p.hist != nil {
+			if hist == nil {
+				hist = makeLatHist()
+			}
+			hist.merge(p.hist)
+		}
+	}
+	return IntervalStats{loop, name, mode, bytes, keys, slowdowns, nanos, tmpLat, hist}
 }
 
 // Only safe to call from the calling thread
 func (stats *Stats) updateIntervals(thread_num int) int64 {
 	curInterval := stats.threadStats[thread_num].curInterval
-	newInterval := stats.threadStats[thread_num].updateIntervals(stats.loop, stats.mode, stats.intervalNano)
+	var newInterval int64
+	if stats.soak != nil {
+		newInterval = stats.soak.updateIntervals(stats, thread_num)
+	} else {
+		newInterval = stats.threadStats[thread_num].updateIntervals(stats.loop, stats.mode, stats.intervalNano)
+	}
 
 	// Finish has already been called
 	if curInterval < 0 {
@@ -437,29 +583,60 @@ func (stats *Stats) updateIntervals(thread_num int) int64 {
 
 		count := atomic.AddInt32(cp, 1)
 		if count == int32(stats.threads) {
-			if is, ok := stats.makeOutputStats(i); ok {
+			if stats.soak != nil {
+				stats.soak.interval(stats, i)
+			} else if is, ok := stats.makeOutputStats(i); ok {
 				is.log()
+				writeResult(&is)
 			}
 		}
 	}
 	return newInterval
 }
 
+// warmingUp -- whether ops still go to the warm-up, before startNano
+func (stats *Stats) warmingUp() bool {
+	return stats.warmupNano > 0 && time.Now().UnixNano() < stats.startNano
+}
+
+// current -- the interval the thread counts its ops in, the warm-up before
+// startNano and nil once the thread finished
+func (stats *Stats) current(thread_num int) *IntervalStats {
+	ts := &stats.threadStats[thread_num]
+	if ts.curInterval < 0 {
+		return nil
+	}
+	if stats.warmingUp() {
+		return &ts.warmup
+	}
+	return ts.interval(ts.curInterval)
+}
+
 func (stats *Stats) addOp(thread_num int, bytes int64, latNano int64) {
 
 	// Interval statistics
-	cur := stats.threadStats[thread_num].curInterval
-	if cur < 0 {
+	is := stats.current(thread_num)
+	if is == nil {
 		return
 	}
-	stats.threadStats[thread_num].intervals[cur].bytes += bytes
-	stats.threadStats[thread_num].intervals[cur].latNano =
-		append(stats.threadStats[thread_num].intervals[cur].latNano, latNano)
+	is.bytes += bytes
+	if is.hist != nil {
+		is.hist.add(latNano)
+	} else {
+		is.latNano = append(is.latNano, latNano)
+	}
+}
+
+func (stats *Stats) addKeys(thread_num int, keys int64) {
+	if is := stats.current(thread_num); is != nil {
+		is.keys += keys
+	}
 }
 
 func (stats *Stats) addSlowDown(thread_num int) {
-	cur := stats.threadStats[thread_num].curInterval
-	stats.threadStats[thread_num].intervals[cur].slowdowns++
+	if is := stats.current(thread_num); is != nil {
+		is.slowdowns++
+	}
 }
 
 func (stats *Stats) finish(thread_num int) {
@@ -471,404 +648,1178 @@ func (stats *Stats) finish(thread_num int) {
 	}
 }
 
-func runUpload(thread_num int, fendtime time.Time, stats *Stats) {
-	errcnt := 0
-	svc := s3.New(session.New(), cfg)
-	for {
-		if duration_secs > -1 && time.Now().After(endtime) {
-			break
-		}
-		objnum := atomic.AddInt64(&op_counter, 1)
-		bucket_num := objnum % int64(bucket_count)
-		if object_count > -1 && objnum >= object_count {
-			objnum = atomic.AddInt64(&op_counter, -1)
-			break
-		}
-		fileobj := bytes.NewReader(object_data)
+// opContext -- handed to every op by runOps so it can time its requests
+// and report them to the stats of the test
+type opContext struct {
+	ctx     context.Context
+	thread  int
+	streams []*Stats
+	start   int64
+	end     int64
+	errcnt  int
+	stage   *Stage
+	// The random numbers of the thread, see threadRand
+	rnd *rand.Rand
+	// The mode being run and the bucket of the current request, the
+	// labels of its metrics
+	mode   string
+	bucket string
+	// The context of the thread and the -timeout of the current request
+	base   context.Context
+	cancel context.CancelFunc
+}
 
-		key := fmt.Sprintf("%s%012d", object_prefix, objnum)
-		r := &s3.PutObjectInput{
-			Bucket: &buckets[bucket_num],
-			Key:    &key,
-			Body:   fileobj,
-		}
-		start := time.Now().UnixNano()
-		req, _ := svc.PutObjectRequest(r)
-		// Disable payload checksum calculation (very expensive)
-		req.HTTPRequest.Header.Add("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
-		err := req.Send()
-		end := time.Now().UnixNano()
-		stats.updateIntervals(thread_num)
+// Backoff before the first retry of a failed request, doubling up to a
+// second for every further retry
+const retryBackoff = 25 * time.Millisecond
 
-		if err != nil {
-			errcnt++
-			stats.addSlowDown(thread_num)
-			atomic.AddInt64(&op_counter, -1)
-			log.Printf("upload err", err)
-		} else {
-			// Update the stats
-			stats.addOp(thread_num, object_size, end-start)
-		}
-		if errcnt > 2 {
-			break
-		}
+// begin -- start timing a request to bucket
+func (oc *opContext) begin(bucket string) {
+	oc.bucket = bucket
+	oc.start = time.Now().UnixNano()
+	oc.end = 0
+}
+
+// stop -- stop timing the request.  Ops call this before reading a
+// response body, everything else stops the clock implicitly.
+func (oc *opContext) stop() {
+	if oc.end != 0 {
+		return
+	}
+	oc.end = time.Now().UnixNano()
+	for _, s := range oc.streams {
+		s.updateIntervals(oc.thread)
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
 }
 
-func runDownload(thread_num int, fendtime time.Time, stats *Stats) {
-	errcnt := 0
-	svc := s3.New(session.New(), cfg)
-	for {
-		if duration_secs > -1 && time.Now().After(endtime) {
-			break
-		}
+// done -- count the request as one op moving bytes in stream
+func (oc *opContext) done(stream int, bytes int64) {
+	oc.stop()
+	oc.streams[stream].addOp(oc.thread, bytes, oc.end-oc.start)
+	if !oc.streams[stream].warmingUp() {
+		metricOp(oc.metricKey(stream), bytes, oc.end-oc.start)
+	}
+}
 
-		objnum := atomic.AddInt64(&op_counter, 1)
-		if object_count > -1 && objnum >= object_count {
-			atomic.AddInt64(&op_counter, -1)
-			break
-		}
+// keys -- add the keys listed or removed by the request to stream
+func (oc *opContext) keys(stream int, keys int64) {
+	oc.streams[stream].addKeys(oc.thread, keys)
+}
 
-		bucket_num := objnum % int64(bucket_count)
-		key := fmt.Sprintf("%s%012d", object_prefix, objnum)
-		r := &s3.GetObjectInput{
-			Bucket: &buckets[bucket_num],
-			Key:    &key,
-		}
+// fail -- count the request as failed with err in stream, the op logs why
+func (oc *opContext) fail(stream int, err error) {
+	oc.stop()
+	oc.errcnt++
+	oc.streams[stream].addSlowDown(oc.thread)
+	if !oc.streams[stream].warmingUp() {
+		metricError(oc.metricKey(stream), oc.ctx, err)
+	}
+}
 
-		start := time.Now().UnixNano()
-		req, resp := svc.GetObjectRequest(r)
-		err := req.Send()
-		end := time.Now().UnixNano()
-		stats.updateIntervals(thread_num)
+// metricKey -- the labels of the metrics of the request in stream
+func (oc *opContext) metricKey(stream int) metricKey {
+	return metricKey{oc.mode, oc.streams[stream].mode, oc.bucket}
+}
 
-		if err != nil {
-			errcnt++
-			stats.addSlowDown(thread_num)
-			log.Printf("download err", err)
-		} else {
-			io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
-			// Update the stats
-			stats.addOp(thread_num, object_size, end-start)
+// size -- the size of object objnum in the current stage
+func (oc *opContext) size(objnum int64) int64 {
+	return oc.stage.sizes.size(objnum)
+}
+
+// deadline -- give oc.ctx a new timeout, cancelling the previous one.  No
+// timeout is set when d is 0.
+func (oc *opContext) deadline(d time.Duration) {
+	if oc.cancel != nil {
+		oc.cancel()
+		oc.cancel = nil
+	}
+	oc.ctx = oc.base
+	if d > 0 {
+		oc.ctx, oc.cancel = context.WithTimeout(oc.base, d)
+	}
+}
+
+// try -- send a request, retrying it up to -retries times if it fails in
+// a way that is worth retrying.  Every attempt gets its own -timeout and
+// every failed attempt but the last is counted in stream right away.  The
+// clock keeps running across the retries, so the latency of the request
+// includes them.  The error of the last attempt is returned for the op to
+// pass to fail.
+func (oc *opContext) try(stream int, send func() error) error {
+	timeout := time.Duration(request_timeout * float64(time.Second))
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		oc.deadline(timeout)
+		metricBusy(1)
+		err := send()
+		metricBusy(-1)
+		if err == nil || attempt >= retries || !retryable(oc.ctx, err) {
+			return err
 		}
-		if errcnt > 2 {
-			break
+		oc.stop()
+		oc.streams[stream].addSlowDown(oc.thread)
+		if !oc.streams[stream].warmingUp() {
+			metricError(oc.metricKey(stream), oc.ctx, err)
+		}
+		oc.end = 0
+		time.Sleep(time.Duration(oc.rnd.Int63n(int64(backoff))))
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
 		}
-
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
 }
 
-func runDelete(thread_num int, stats *Stats) {
-	errcnt := 0
-	svc := s3.New(session.New(), cfg)
+// modeSpec -- what runWrapper needs to know to run one of the -m modes
+type modeSpec struct {
+	// Test description and the names of the latency streams it reports
+	desc  string
+	names []string
+	// Number of op numbers to hand out, -1 for no limit
+	limit func() int64
+	// Bucket tests run to completion, ignoring -d and failed ops
+	bucket bool
+	// Run op number n, returning false to stop the thread
+	op func(oc *opContext, n int64) bool
+}
 
+func objectLimit() int64 { return object_count }
+func bucketLimit() int64 { return bucket_count }
+func listLimit() int64   { return bucket_count * int64(list_concurrency) }
+func noLimit() int64     { return -1 }
+
+var modeSpecs = map[rune]modeSpec{
+	'c': {"BUCKET CLEAR", []string{"BCLR"}, noLimit, true, opClear},
+	'x': {"BUCKET DELETE", []string{"BDEL"}, bucketLimit, true, opBucketDelete},
+	'i': {"BUCKET INIT", []string{"BINIT"}, bucketLimit, true, opBucketInit},
+	'p': {"OBJECT PUT", []string{"PUT"}, objectLimit, false, opPut},
+	'l': {"BUCKET LIST", []string{"LIST"}, listLimit, true, opList},
+	'g': {"OBJECT GET", []string{"GET"}, objectLimit, false, opGet},
+	'h': {"OBJECT HEAD", []string{"HEAD", "HEADMISS"}, objectLimit, false, opHead},
+	'y': {"OBJECT COPY", []string{"COPY"}, objectLimit, false, opCopy},
+	'v': {"OBJECT VERSION PUT", []string{"PUTVER"}, objectLimit, false, opVersionPut},
+	'r': {"OBJECT VERSION GET", []string{"GETVER"}, objectLimit, false, opVersionGet},
+	'o': {"BUCKET VERSION LIST", []string{"LISTVER"}, listLimit, true, opVersionList},
+	'k': {"OBJECT VERSION DELETE", []string{"DELVER"}, objectLimit, false, opVersionDelete},
+	'b': {"OBJECT BATCH DELETE", []string{"BATCHDEL"}, noLimit, false, opBatchDelete},
+	'd': {"OBJECT DELETE", []string{"DEL"}, objectLimit, false, opDelete},
+}
+
+// pace -- wait for the next slot of a stage limited to rate ops per second.
+// Slots are shared by all threads, so a stage that falls behind catches up.
+// Returns false without waiting if the slot is past the end of a timed
+// stage.
+func pace(rate float64, timed bool) bool {
+	gap := int64(1e9 / rate)
+	slot := atomic.AddInt64(&pace_next, gap) - gap
+	if timed && slot > endtime.UnixNano() {
+		return false
+	}
+	if d := slot - time.Now().UnixNano(); d > 0 {
+		time.Sleep(time.Duration(d))
+	}
+	return true
+}
+
+// runOps -- the worker loop of every stage.  Each op number handed out by
+// op_counter goes to one of the modes of the stage until the limit is
+// reached, the stage runs out of time or the thread has seen too many
+// errors.  streams holds the latency streams of each mode.
+func runOps(thread_num int, st *Stage, specs []modeSpec, streams [][]*Stats, limit int64) {
+	oc := &opContext{ctx: context.Background(), base: context.Background(), thread: thread_num, stage: st, rnd: threadRand(thread_num)}
+	bucket := specs[0].bucket
+	timed := !bucket && st.Duration > -1
 	for {
-		if duration_secs > -1 && time.Now().After(endtime) {
+		if st.Rate > 0 && !pace(st.Rate, timed) {
 			break
 		}
-
-		objnum := atomic.AddInt64(&op_counter, 1)
-		if object_count > -1 && objnum >= object_count {
+		if timed && time.Now().After(endtime) {
+			break
+		}
+		if !bucket && atomic.LoadInt32(&stop_stage) != 0 {
+			break
+		}
+		n := atomic.AddInt64(&op_counter, 1)
+		if limit > -1 && n >= limit {
 			atomic.AddInt64(&op_counter, -1)
 			break
 		}
+		m := st.pick(oc.rnd)
+		oc.streams = streams[m]
+		oc.mode = string(st.modes[m])
+		ok := specs[m].op(oc, st.objnum(n))
+		oc.deadline(0)
+		if !ok {
+			break
+		}
+		if !bucket && max_errors > -1 && oc.errcnt >= max_errors {
+			break
+		}
+	}
+	for _, ss := range streams {
+		for _, s := range ss {
+			s.finish(thread_num)
+		}
+	}
+	atomic.AddInt64(&running_threads, -1)
+}
 
-		bucket_num := objnum % int64(bucket_count)
+func opPut(oc *opContext, objnum int64) bool {
+	bucket := buckets[objnum%bucket_count]
+	key := keygen.key(objnum)
+	size := oc.size(objnum)
+	oc.begin(bucket)
+	err := oc.try(0, func() error {
+		_, err := backend.PutObject(oc.ctx, bucket, key, object_data[:size])
+		return err
+	})
+	if err != nil {
+		oc.fail(0, err)
+		atomic.AddInt64(&op_counter, -1)
+		log.Printf("upload err: %v", err)
+		return true
+	}
+	oc.done(0, size)
+	return true
+}
 
-		key := fmt.Sprintf("%s%012d", object_prefix, objnum)
-		r := &s3.DeleteObjectInput{
-			Bucket: &buckets[bucket_num],
-			Key:    &key,
+func opGet(oc *opContext, objnum int64) bool {
+	bucket := buckets[objnum%bucket_count]
+	key := keygen.key(objnum)
+	oc.begin(bucket)
+	var n int64
+	err := oc.try(0, func() error {
+		body, err := backend.GetObject(oc.ctx, bucket, key, "")
+		if err != nil {
+			return err
 		}
+		oc.stop()
+		n, err = drainBody(body)
+		return err
+	})
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("download err: %v", err)
+		return true
+	}
+	oc.done(0, n)
+	return true
+}
 
-		start := time.Now().UnixNano()
-		req, out := svc.DeleteObjectRequest(r)
-		err := req.Send()
-		end := time.Now().UnixNano()
-		stats.updateIntervals(thread_num)
-
+func opHead(oc *opContext, objnum int64) bool {
+	bucket := buckets[objnum%bucket_count]
+	// Some fraction of the lookups target keys that were never written
+	// so that the cost of the 404 path is measured as well.
+	miss := head_miss_ratio > 0 && oc.rnd.Float64() < head_miss_ratio
+	key := keygen.key(objnum)
+	if miss {
+		key = keygen.key(objnum) + ".miss"
+	}
+	stream := 0
+	if miss {
+		stream = 1
+	}
+	found := false
+	oc.begin(bucket)
+	err := oc.try(stream, func() error {
+		_, err := backend.HeadObject(oc.ctx, bucket, key)
+		if miss && isNotFound(err) {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if miss {
 		if err != nil {
-			errcnt++
-			stats.addSlowDown(thread_num)
-			log.Printf("delete err", err, "out", out.String())
-		} else {
-			// Update the stats
-			stats.addOp(thread_num, object_size, end-start)
+			oc.fail(1, err)
+			log.Printf("head miss err: %v", err)
+			return true
 		}
-		if errcnt > 2 {
-			break
+		if found {
+			// The key unexpectedly exists, but the lookup still counts
+			log.Printf("head miss found key %s in bucket %s", key, bucket)
+		}
+		oc.done(1, 0)
+	} else {
+		if err != nil {
+			oc.fail(0, err)
+			log.Printf("head err: %v", err)
+		} else {
+			oc.done(0, 0)
 		}
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
+	return true
 }
 
-func runBucketDelete(thread_num int, stats *Stats) {
-	svc := s3.New(session.New(), cfg)
+func opCopy(oc *opContext, objnum int64) bool {
+	// The destination is always named after the op, but the source
+	// can be any of the objects written by the previous put test.
+	srcnum := objnum
+	if copy_key_select == "rand" && object_count > 0 {
+		srcnum = oc.rnd.Int63n(object_count)
+	}
+	src_bucket := buckets[srcnum%bucket_count]
+	dst_bucket := src_bucket
+	if copy_dest == "cross" {
+		dst_bucket = buckets[(srcnum+1)%bucket_count]
+	}
+	src_key := keygen.key(srcnum)
+	dst_key := keygen.key(objnum) + ".copy"
+	size := oc.size(srcnum)
+
+	oc.begin(dst_bucket)
+	err := oc.try(0, func() error {
+		return backend.(Copier).CopyObject(oc.ctx, src_bucket, src_key, dst_bucket, dst_key, size)
+	})
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("copy err: %v", err)
+		return true
+	}
+	oc.done(0, size)
+	return true
+}
 
-	for {
-		bucket_num := atomic.AddInt64(&op_counter, 1)
-		if bucket_num >= bucket_count {
-			atomic.AddInt64(&op_counter, -1)
-			break
-		}
-		r := &s3.DeleteBucketInput{
-			Bucket: &buckets[bucket_num],
-		}
+func opDelete(oc *opContext, objnum int64) bool {
+	bucket := buckets[objnum%bucket_count]
+	key := keygen.key(objnum)
+	oc.begin(bucket)
+	err := oc.try(0, func() error {
+		return backend.DeleteObject(oc.ctx, bucket, key, "")
+	})
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("delete err: %v", err)
+		return true
+	}
+	oc.done(0, oc.size(objnum))
+	return true
+}
 
-		start := time.Now().UnixNano()
-		_, err := svc.DeleteBucket(r)
-		end := time.Now().UnixNano()
-		stats.updateIntervals(thread_num)
+func opBucketInit(oc *opContext, bucket_num int64) bool {
+	bucket := buckets[bucket_num]
+	oc.begin(bucket)
+	err := oc.try(0, func() error {
+		return backend.CreateBucket(oc.ctx, bucket)
+	})
+	if err != nil {
+		log.Fatalf("FATAL: Unable to create bucket %s (is your access and secret correct?): %v", bucket, err)
+	}
+	oc.done(0, 0)
 
+	if versioning {
+		err = oc.try(0, func() error {
+			return backend.(Versioner).EnableVersioning(oc.ctx, bucket)
+		})
 		if err != nil {
-			break
+			log.Fatalf("FATAL: Unable to enable versioning on bucket %s: %v", bucket, err)
 		}
-		stats.addOp(thread_num, 0, end-start)
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
+	return true
 }
 
-func runBucketList(thread_num int, stats *Stats) {
-	svc := s3.New(session.New(), cfg)
-
-	for {
-		bucket_num := atomic.AddInt64(&op_counter, 1)
-		if bucket_num >= bucket_count {
-			atomic.AddInt64(&op_counter, -1)
-			break
-		}
+func opBucketDelete(oc *opContext, bucket_num int64) bool {
+	bucket := buckets[bucket_num]
+	// Leftover multipart uploads keep a bucket from being deleted
+	abortUploads(oc.ctx, bucket)
+	if clear_dry_run {
+		log.Printf("Would delete bucket %s", bucket)
+		return true
+	}
 
-		start := time.Now().UnixNano()
-		err := svc.ListObjectsPages(
-			&s3.ListObjectsInput{
-				Bucket:  &buckets[bucket_num],
-				MaxKeys: &max_keys,
-			},
-			func(p *s3.ListObjectsOutput, last bool) bool {
-				end := time.Now().UnixNano()
-				stats.updateIntervals(thread_num)
-				stats.addOp(thread_num, 0, end-start)
-				start = time.Now().UnixNano()
-				return true
-			})
+	oc.begin(bucket)
+	err := oc.try(0, func() error {
+		return backend.DeleteBucket(oc.ctx, bucket)
+	})
+	if isNotFound(err) {
+		return true
+	}
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("Unable to delete bucket %s: %v", bucket, err)
+		return true
+	}
+	oc.done(0, 0)
+	return true
+}
 
-		if err != nil {
-			break
+// listPrefix -- return the prefix for the next listing
+func listPrefix(rnd *rand.Rand) string {
+	// Random prefix listings drop the trailing digits of a random key so
+	// that each listing covers a different slice of the namespace.
+	if list_random_prefix > 0 && object_count > 0 {
+		key := keygen.key(rnd.Int63n(object_count))
+		if list_random_prefix >= len(key) {
+			return ""
 		}
+		return key[:len(key)-list_random_prefix]
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
+	return list_prefix
+}
+
+// listPages -- run a listing, counting every page as one op
+func listPages(oc *opContext, bucket string, opts ListOptions) error {
+	oc.begin(bucket)
+	metricBusy(1)
+	defer metricBusy(-1)
+	return backend.List(oc.ctx, bucket, opts, func(p ListPage) bool {
+		oc.done(0, 0)
+		oc.keys(0, int64(len(p.Objects)+len(p.Prefixes)))
+		oc.begin(bucket)
+		return true
+	})
 }
 
-var cfg *aws.Config
+func opList(oc *opContext, job int64) bool {
+	// Every bucket is listed by list_concurrency threads at once
+	err := listPages(oc, buckets[job%bucket_count], ListOptions{
+		Prefix:     listPrefix(oc.rnd),
+		Delimiter:  list_delimiter,
+		StartAfter: list_start_after,
+		MaxKeys:    max_keys,
+		Version:    list_version,
+	})
+	if err != nil {
+		log.Printf("list err: %v", err)
+		return false
+	}
+	return true
+}
 
-func runBucketsInit(thread_num int, stats *Stats) {
-	svc := s3.New(session.New(), cfg)
+// deleteBatch -- a set of keys from one bucket to remove with DeleteObjects
+type deleteBatch struct {
+	bucket  string
+	objects []ObjectId
+	bytes   int64
+}
 
-	for {
-		bucket_num := atomic.AddInt64(&op_counter, 1)
-		if bucket_num >= bucket_count {
-			atomic.AddInt64(&op_counter, -1)
+func opBatchDelete(oc *opContext, opnum int64) bool {
+	// Each op deletes batch_delete_size objects from a single bucket
+	// since DeleteObjects can't span buckets.  Op n covers round
+	// n / bucket_count of the objects in bucket n % bucket_count.
+	bucket_num := opnum % bucket_count
+	first := bucket_num + bucket_count*(opnum/bucket_count)*int64(batch_delete_size)
+	if object_count > -1 && first >= object_count {
+		return false
+	}
+	batch := deleteBatch{bucket: buckets[bucket_num]}
+	for objnum := first; len(batch.objects) < batch_delete_size; objnum += bucket_count {
+		if object_count > -1 && objnum >= object_count {
 			break
 		}
-		start := time.Now().UnixNano()
-		in := &s3.CreateBucketInput{Bucket: aws.String(buckets[bucket_num])}
-		_, err := svc.CreateBucket(in)
-		end := time.Now().UnixNano()
-		stats.updateIntervals(thread_num)
+		batch.objects = append(batch.objects, ObjectId{Key: keygen.key(objnum)})
+		batch.bytes += oc.size(objnum)
+	}
 
-		if err != nil {
-			if !strings.Contains(err.Error(), s3.ErrCodeBucketAlreadyOwnedByYou) &&
-				!strings.Contains(err.Error(), "BucketAlreadyExists") {
-				log.Fatalf("FATAL: Unable to create bucket %s (is your access and secret correct?): %v", buckets[bucket_num], err)
-			}
-		}
-		stats.addOp(thread_num, 0, end-start)
+	oc.begin(batch.bucket)
+	var n int
+	err := oc.try(0, func() (err error) {
+		n, err = backend.DeleteObjects(oc.ctx, batch.bucket, batch.objects)
+		return err
+	})
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("batch delete err: %v", err)
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
+	if n > 0 {
+		oc.done(0, batch.bytes*int64(n)/int64(len(batch.objects)))
+		oc.keys(0, int64(n))
+	}
+	return true
 }
 
-func runBucketsClear(thread_num int, stats *Stats) {
-	svc := s3.New(session.New(), cfg)
+// The batches listed by listForClear for the clear threads to delete
+var clearBatches chan deleteBatch
 
-	for {
-		bucket_num := atomic.AddInt64(&op_counter, 1)
-		if bucket_num >= bucket_count {
-			atomic.AddInt64(&op_counter, -1)
-			break
+// abortUploads -- abort the in-progress multipart uploads left in a
+// bucket, subject to the same scoping as bucket clears
+func abortUploads(ctx context.Context, bucket string) {
+	aborter, ok := backend.(UploadAborter)
+	if !ok {
+		return
+	}
+	prefix := ""
+	if !clear_all {
+		prefix = object_prefix
+	}
+	found := 0
+	aborted := 0
+	skipped := 0
+	err := aborter.ListUploads(ctx, bucket, prefix, func(key string, uploadId string) bool {
+		found++
+		if !clear_all && !keygen.matches(key) {
+			skipped++
+			return true
 		}
-		out, err := svc.ListObjects(&s3.ListObjectsInput{Bucket: &buckets[bucket_num]})
-		if err != nil {
-			break
+		if clear_dry_run {
+			log.Printf("Would abort multipart upload %s of %s/%s", uploadId, bucket, key)
+			return true
+		}
+		if err := aborter.AbortUpload(ctx, bucket, key, uploadId); err != nil {
+			log.Printf("Unable to abort multipart upload %s of %s/%s: %v", uploadId, bucket, key, err)
+			return true
 		}
-		n := len(out.Contents)
-		for n > 0 {
-			for _, v := range out.Contents {
-				start := time.Now().UnixNano()
-				svc.DeleteObject(&s3.DeleteObjectInput{
-					Bucket: &buckets[bucket_num],
-					Key:    v.Key,
-				})
-				end := time.Now().UnixNano()
-				stats.updateIntervals(thread_num)
-				stats.addOp(thread_num, *v.Size, end-start)
+		aborted++
+		return true
+	})
+	if err != nil {
+		// A bucket that doesn't exist yet has nothing to clean up
+		if !isNotFound(err) {
+			log.Printf("Unable to list multipart uploads in bucket %s: %v", bucket, err)
+		}
+		return
+	}
+	if found > 0 {
+		log.Printf("Found %d incomplete multipart uploads in bucket %s, aborted %d, skipped %d not created by hsbench",
+			found, bucket, aborted, skipped)
+	}
+}
+
+// clearListOptions -- the listing of the objects a clear of bucket covers
+func clearListOptions(ctx context.Context, bucket string) ListOptions {
+	// Unless told otherwise only look at the objects of this run
+	opts := ListOptions{MaxKeys: int64(batch_delete_size), Version: 2}
+	if !clear_all {
+		opts.Prefix = object_prefix
+	}
+	// Versioned buckets have to be purged of every version and delete
+	// marker, otherwise the bucket can't be deleted.
+	if v, ok := backend.(Versioner); ok {
+		if on, err := v.IsVersioned(ctx, bucket); err == nil && on {
+			opts.Versions = true
+		}
+	}
+	return opts
+}
+
+// checkClear -- list every bucket before a clear deletes anything, and
+// refuse to go on if any of them holds an object under the object prefix
+// that doesn't match the key layout
+func checkClear() {
+	if clear_all {
+		return
+	}
+	ctx := context.Background()
+	var refused sync.Map
+	var wg sync.WaitGroup
+	for _, bucket := range buckets {
+		wg.Add(1)
+		go func(bucket string) {
+			defer wg.Done()
+			err := backend.List(ctx, bucket, clearListOptions(ctx, bucket), func(p ListPage) bool {
+				for _, o := range p.Objects {
+					if !keygen.matches(o.Key) {
+						refused.Store(bucket, o.Key)
+						return false
+					}
+				}
+				return true
+			})
+			if err != nil && !isNotFound(err) {
+				log.Printf("clear list err for bucket %s: %v", bucket, err)
+			}
+		}(bucket)
+	}
+	wg.Wait()
+	found := false
+	refused.Range(func(k, v interface{}) bool {
+		log.Printf("Refusing to clear bucket %s, it contains %s which was not created by hsbench", k, v)
+		found = true
+		return true
+	})
+	if found {
+		log.Fatal("Buckets contain objects that don't match the key layout, nothing was deleted, use -clear-all to delete everything")
+	}
+}
 
+// listForClear -- page through every bucket and hand the keys to the
+// clear threads in DeleteObjects sized batches
+func listForClear(batches chan<- deleteBatch) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for _, bucket := range buckets {
+		wg.Add(1)
+		go func(bucket string) {
+			defer wg.Done()
+			abortUploads(ctx, bucket)
+			batch := deleteBatch{bucket: bucket}
+			opts := clearListOptions(ctx, bucket)
+
+			listed := 0
+			add := func(o ObjectId) {
+				// Keys checkClear found none of, but that showed up
+				// since, are left alone
+				if !clear_all && !keygen.matches(o.Key) {
+					return
+				}
+				listed++
+				if clear_dry_run {
+					if o.VersionId != "" {
+						log.Printf("Would delete %s/%s version %s", bucket, o.Key, o.VersionId)
+					} else {
+						log.Printf("Would delete %s/%s", bucket, o.Key)
+					}
+					return
+				}
+				batch.objects = append(batch.objects, o)
+				batch.bytes += o.Size
+				if len(batch.objects) == batch_delete_size {
+					batches <- batch
+					batch = deleteBatch{bucket: bucket}
+				}
 			}
-			out, err = svc.ListObjects(&s3.ListObjectsInput{Bucket: &buckets[bucket_num]})
-			if err != nil {
-				break
+			err := backend.List(ctx, bucket, opts, func(p ListPage) bool {
+				for _, o := range p.Objects {
+					add(o)
+				}
+				return true
+			})
+			if len(batch.objects) > 0 {
+				batches <- batch
 			}
-			n = len(out.Contents)
-		}
+			if err != nil && !isNotFound(err) {
+				log.Printf("clear list err for bucket %s: %v", bucket, err)
+			}
+			if clear_dry_run {
+				log.Printf("Would delete %d objects from bucket %s", listed, bucket)
+			}
+		}(bucket)
 	}
-	stats.finish(thread_num)
-	atomic.AddInt64(&running_threads, -1)
+	wg.Wait()
+	close(batches)
 }
 
-func runWrapper(loop int, r rune) []OutputStats {
+func opClear(oc *opContext, n int64) bool {
+	batch, ok := <-clearBatches
+	if !ok {
+		return false
+	}
+	oc.begin(batch.bucket)
+	var deleted int
+	err := oc.try(0, func() (err error) {
+		deleted, err = backend.DeleteObjects(oc.ctx, batch.bucket, batch.objects)
+		return err
+	})
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("clear err for bucket %s: %v", batch.bucket, err)
+	}
+	if deleted > 0 {
+		oc.done(0, batch.bytes*int64(deleted)/int64(len(batch.objects)))
+		oc.keys(0, int64(deleted))
+	}
+	return true
+}
+
+func runWrapper(loop int, st *Stage) []OutputStats {
 	op_counter = -1
-	running_threads = int64(threads)
+	running_threads = int64(st.Threads)
 	intervalNano := int64(interval * 1000000000)
-	endtime = time.Now().Add(time.Second * time.Duration(duration_secs))
-	var stats Stats
+	// Object modes can start their threads gradually and warm up before
+	// the ops count, all of it on top of the duration
+	warmupNano := int64(0)
+	rampupNano := int64(0)
+	if !modeSpecs[st.modes[0]].bucket {
+		rampupNano = int64(math.Max(st.Rampup, 0) * 1000000000)
+		warmupNano = rampupNano + int64(math.Max(st.Warmup, 0)*1000000000)
+	}
+	endtime = time.Now().Add(time.Second*time.Duration(st.Duration) + time.Duration(warmupNano))
+	// A mode looking for a steady state may run past its duration
+	steady := steady_intervals > 0 && !modeSpecs[st.modes[0]].bucket
+	baseEnd := endtime
+	if steady && st.Duration > -1 && steady_max > float64(st.Duration) {
+		endtime = time.Now().Add(time.Duration(steady_max*1000000000) + time.Duration(warmupNano))
+	}
+	stop_stage = 0
+	pace_next = time.Now().UnixNano()
+	cpuStart := processCPUNano()
 
 	// If we perviously set the object count after running a put
 	// test, set the object count back to -1 for the new put test.
-	if r == 'p' && object_count_flag {
+	// Puts to a key range only add to the objects already there.
+	if (st.has('p') || st.has('v')) && object_count_flag && st.keyCount == 0 {
 		object_count = -1
 		object_count_flag = false
 	}
 
-	switch r {
-	case 'c':
-		log.Printf("Running Loop %d BUCKET CLEAR TEST", loop)
-		stats = makeStats(loop, "BCLR", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runBucketsClear(n, &stats)
-		}
-	case 'x':
-		log.Printf("Running Loop %d BUCKET DELETE TEST", loop)
-		stats = makeStats(loop, "BDEL", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runBucketDelete(n, &stats)
-		}
-	case 'i':
-		log.Printf("Running Loop %d BUCKET INIT TEST", loop)
-		stats = makeStats(loop, "BINIT", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runBucketsInit(n, &stats)
-		}
-	case 'p':
-		log.Printf("Running Loop %d OBJECT PUT TEST", loop)
-		stats = makeStats(loop, "PUT", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runUpload(n, endtime, &stats)
-		}
-	case 'l':
-		log.Printf("Running Loop %d BUCKET LIST TEST", loop)
-		stats = makeStats(loop, "LIST", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runBucketList(n, &stats)
-		}
-	case 'g':
-		log.Printf("Running Loop %d OBJECT GET TEST", loop)
-		stats = makeStats(loop, "GET", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runDownload(n, endtime, &stats)
-		}
-	case 'd':
-		log.Printf("Running Loop %d OBJECT DELETE TEST", loop)
-		stats = makeStats(loop, "DEL", threads, intervalNano)
-		for n := 0; n < threads; n++ {
-			go runDelete(n, &stats)
-		}
-	}
-
-	// Wait for it to finish
+	log.Printf("Running Loop %d %s TEST", loop, st.desc())
+	if warmupNano > 0 {
+		log.Printf("Ramping up over %.1fs and warming up for %.1fs before counting ops",
+			float64(rampupNano)/1000000000, float64(warmupNano-rampupNano)/1000000000)
+	}
+	// Every mode of the stage reports its own latency streams, and modes
+	// that report more than one stream have several names
+	specs := make([]modeSpec, len(st.modes))
+	streams := make([][]*Stats, len(st.modes))
+	allStats := make([]*Stats, 0)
+	for m, r := range st.modes {
+		specs[m] = modeSpecs[r]
+		for _, name := range specs[m].names {
+			stats := makeStats(loop, name, st.Threads, intervalNano, warmupNano)
+			streams[m] = append(streams[m], &stats)
+			allStats = append(allStats, &stats)
+		}
+	}
+	if st.has('c') {
+		checkClear()
+		if !clear_dry_run {
+			resetVersions()
+		}
+		clearBatches = make(chan deleteBatch, 2*st.Threads)
+		go listForClear(clearBatches)
+	}
+	limit := specs[0].limit()
+	if st.Count != 0 && !specs[0].bucket {
+		limit = st.Count
+	}
+	makeThreadRands(st.Threads)
+	for n := 0; n < st.Threads; n++ {
+		go runOps(n, st, specs, streams, limit)
+		if rampupNano > 0 && n < st.Threads-1 {
+			time.Sleep(time.Duration(rampupNano / int64(st.Threads-1)))
+		}
+	}
+
+	// Wait for it to finish, only counting the client CPU from the end of
+	// the warm-up
+	warming := warmupNano > 0
+	watch := makeSteadyWatch(allStats)
 	for atomic.LoadInt64(&running_threads) > 0 {
+		if warming && time.Now().UnixNano() >= allStats[0].startNano {
+			cpuStart = processCPUNano()
+			warming = false
+		}
+		// Stop once steady if asked to, or at the end of the duration
+		// if it was extended
+		if steady && watch.poll() && (steady_stop || time.Now().After(baseEnd)) {
+			stopStage()
+		}
 		time.Sleep(time.Millisecond)
 	}
+	if steady && !watch.poll() {
+		log.Printf("Steady state not reached")
+	}
 
 	// If the user didn't set the object_count, we can set it here
 	// to limit subsequent get/del tests to valid objects only.
-	if r == 'p' && object_count < 0 {
-		object_count = op_counter + 1
+	if (st.has('p') || st.has('v')) && (object_count < 0 || object_count_flag) {
+		written := op_counter + 1
+		if st.keyCount > 0 {
+			if written > st.keyCount {
+				written = st.keyCount
+			}
+			written += st.firstKey
+			if written < object_count {
+				written = object_count
+			}
+		}
+		object_count = written
 		object_count_flag = true
 	}
 
+	// The client CPU cost is shared by all the ops of the test
+	cpuNano := processCPUNano() - cpuStart
+	totals := make([]*OutputStats, len(allStats))
+	totalOps := 0
+	for n, s := range allStats {
+		if o, ok := s.makeTotalStats(); ok {
+			totals[n] = &o
+			totalOps += o.Ops
+		}
+	}
+
 	// Create the Output Stats
 	os := make([]OutputStats, 0)
-	for i := int64(0); i >= 0; i++ {
-		if o, ok := stats.makeOutputStats(i); ok {
+	for n, s := range allStats {
+		if o, ok := s.makeWarmupStats(); ok {
+			o.log()
+			writeResult(&o)
 			os = append(os, o)
-		} else {
-			break
+		}
+		// Soak tests wrote their intervals out as they went
+		for i := int64(0); s.soak == nil && i >= 0; i++ {
+			if o, ok := s.makeOutputStats(i); ok {
+				os = append(os, o)
+			} else {
+				break
+			}
+		}
+		if o := totals[n]; o != nil {
+			if totalOps > 0 {
+				o.CpuPerOp = float64(cpuNano) / float64(totalOps) / 1000
+			}
+			o.log()
+			writeResult(o)
+			os = append(os, *o)
 		}
 	}
-	if o, ok := stats.makeTotalStats(); ok {
+	for _, o := range watch.makeSteadyStats() {
 		o.log()
+		writeResult(&o)
 		os = append(os, o)
 	}
+	for _, s := range allStats {
+		if s.soak != nil {
+			os = append(os, s.soak.finish(s)...)
+		}
+	}
 	return os
 }
 
-func init() {
+// parseArgs -- parse and check the command line, outside of init so that
+// tests can set up the run themselves.  Returns the flags, nil for the
+// subcommands.
+func parseArgs() *flag.FlagSet {
+	// "hsbench serve" and "hsbench proxy" have their own options, see
+	// runServe and runProxy
+	if len(os.Args) > 1 && (os.Args[1] == "serve" || os.Args[1] == "proxy") {
+		subcommand = os.Args[1]
+		return nil
+	}
+
 	// Parse command line
 	myflag := flag.NewFlagSet("myflag", flag.ExitOnError)
 	myflag.StringVar(&access_key, "a", os.Getenv("AWS_ACCESS_KEY_ID"), "Access key")
 	myflag.StringVar(&secret_key, "s", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret key")
-	myflag.StringVar(&url_host, "u", os.Getenv("AWS_HOST"), "URL for host with method prefix")
+	myflag.StringVar(&url_host, "u", os.Getenv("AWS_HOST"), "URL for host with method prefix, file:// followed by a directory to test a filesystem, or mem:// for the built-in server")
 	myflag.StringVar(&object_prefix, "op", "", "Prefix for objects")
 	myflag.StringVar(&bucket_prefix, "bp", "hotsauce-bench", "Prefix for buckets")
+	myflag.StringVar(&key_layout, "kl", "flat", "Layout of object keys <flat, tree, hash, template>")
+	myflag.IntVar(&key_depth, "kd", 3, "Number of directory levels for the tree key layout")
+	myflag.Int64Var(&key_fanout, "kf", 26, "Number of entries per directory level for the tree key layout")
+	myflag.Int64Var(&key_per_leaf, "kpl", 1000, "Number of objects per leaf directory for the tree key layout")
+	myflag.IntVar(&key_hash_len, "khl", 4, "Number of hex characters in the leading hash for the hash key layout")
+	myflag.StringVar(&key_template, "kt", "{client}/{thread}/{seq}", "Object name for the template key layout")
+	myflag.StringVar(&key_client, "kc", "", "Value of {client} in key templates <defaults to the hostname>")
 	myflag.StringVar(&region, "r", "us-east-1", "Region for testing")
 	myflag.StringVar(&modes, "m", "cxiplgdcx", "Run modes in order.  See NOTES for more info")
+	myflag.StringVar(&sweepArg, "sweep", "", "Run the modes once for every value of threads, size, buckets or rate, i.e. threads=1,2,4,8")
+	myflag.StringVar(&searchArg, "search", "", "Find the highest threads or rate in a range that meets -slo, i.e. threads=1-256.  See NOTES for more info")
+	myflag.StringVar(&sloArg, "slo", "", "Latency percentile and error limits for -search, i.e. p99<50ms,errors<0.1%")
+	myflag.StringVar(&workload, "w", "", "Run the stages of this YAML or JSON workload file instead of -m.  See NOTES for more info")
 	myflag.StringVar(&output, "o", "", "Write CSV output to this file")
-	myflag.StringVar(&json_output, "j", "", "Write JSON output to this file")
+	myflag.StringVar(&json_output, "j", "", "Write JSON Lines output to this file")
+	myflag.BoolVar(&output_append, "append", false, "Append to the -o and -j files instead of overwriting them")
+	myflag.Var(tags, "tag", "Tag the run with name=value in the -j file, can be repeated, i.e. -tag build=1234 -tag cluster=a")
+	myflag.StringVar(&metrics_listen, "metrics-listen", "", "Serve Prometheus metrics of the run on this address, i.e. :9100.  See NOTES for more info")
+	myflag.Int64Var(&seed, "seed", 0, "Seed of the random object data and of the random choices of the threads, 0 to pick one that is recorded in the -j file")
 	myflag.Int64Var(&max_keys, "mk", 1000, "Maximum number of keys to retreive at once for bucket listings")
+	myflag.IntVar(&list_version, "lv", 1, "ListObjects API version to use for bucket listings <1, 2>")
+	myflag.StringVar(&list_prefix, "lp", "", "Only list keys starting with this prefix")
+	myflag.StringVar(&list_delimiter, "ld", "", "Delimiter used to group keys into common prefixes in bucket listings")
+	myflag.StringVar(&list_start_after, "lsa", "", "Start bucket listings after this key (the marker for v1 listings)")
+	myflag.IntVar(&list_random_prefix, "lrp", 0, "List a random prefix, made by dropping this many trailing digits from a random key <0 to disable>")
+	myflag.IntVar(&list_concurrency, "lc", 1, "Number of threads listing each bucket at the same time")
+	myflag.StringVar(&sse_mode, "sse", "", "Server side encryption for PUT, GET, HEAD and copy requests <AES256, aws:kms, SSE-C>")
+	myflag.StringVar(&sse_kms_key_id, "sse-kms-key", "", "KMS key ID for aws:kms encryption <defaults to the bucket or account key>")
+	myflag.StringVar(&sseCKeyArg, "sse-c-key", "", "Base64 encoded 256 bit key for SSE-C encryption <generated per run if empty>")
+	myflag.StringVar(&driver, "driver", "sdk", "Client used for object PUT, GET, HEAD and DELETE requests to S3 endpoints <sdk, raw>")
+	myflag.BoolVar(&mem_discard, "discard", false, "Have the mem:// server only keep object sizes and return zeroes on GET")
+	myflag.BoolVar(&file_fsync, "fsync", false, "Fsync every object written by the file driver before counting the PUT as done")
+	myflag.BoolVar(&file_odirect, "odirect", false, "Open objects with O_DIRECT in the file driver to bypass the page cache (Linux only)")
+	myflag.StringVar(&signature_version, "sig", "v4", "Signature version used by the raw driver <v2, v4>")
+	myflag.StringVar(&payload_signing, "ps", "unsigned", "Payload signing for PUT requests <unsigned, signed, streaming>")
+	myflag.StringVar(&payload_checksum, "ck", "none", "Checksum sent with PUT requests <none, md5, crc32, crc32c, sha1, sha256>")
+	myflag.BoolVar(&payload_trailer, "ckt", false, "Send the PUT checksum as a trailer of an aws-chunked upload")
+	myflag.BoolVar(&versioning, "ver", false, "Enable versioning on buckets when initializing them")
+	myflag.IntVar(&versions_per_key, "nv", 3, "Number of versions to write for each key in version put tests")
+	myflag.BoolVar(&clear_all, "clear-all", false, "Clear every object from the buckets, not just the ones matching the object prefix and key layout")
+	myflag.BoolVar(&clear_dry_run, "clear-dry-run", false, "Log the objects and buckets that bucket clears and deletes would remove without removing them")
+	myflag.IntVar(&batch_delete_size, "bds", 1000, "Number of keys removed by each DeleteObjects call in batch deletes and bucket clears")
 	myflag.Int64Var(&object_count, "n", -1, "Maximum number of objects <-1 for unlimited>")
 	myflag.Int64Var(&bucket_count, "b", 1, "Number of buckets to distribute IOs across")
 	myflag.IntVar(&duration_secs, "d", 60, "Maximum test duration in seconds <-1 for unlimited>")
 	myflag.IntVar(&threads, "t", 1, "Number of threads to run")
 	myflag.IntVar(&loops, "l", 1, "Number of times to repeat test")
-	myflag.StringVar(&sizeArg, "z", "1M", "Size of objects in bytes with postfix K, M, and G")
+	myflag.StringVar(&sizeArg, "z", "1M", "Size of objects in bytes with postfix K, M, and G, or a size distribution.  See NOTES for more info")
 	myflag.Float64Var(&interval, "ri", 1.0, "Number of seconds between report intervals")
+	myflag.Float64Var(&warmup_secs, "warmup", 0, "Number of seconds the object modes run before their ops are counted")
+	myflag.IntVar(&steady_intervals, "steady", 0, "Number of intervals the object modes have to be stable for to be in a steady state, 0 to not look for one.  See NOTES for more info")
+	myflag.Float64Var(&steady_cv, "steady-cv", 0.05, "Largest coefficient of variation of IO/s and average latency over the -steady intervals")
+	myflag.BoolVar(&steady_stop, "steady-stop", false, "End the object modes as soon as they are steady")
+	myflag.Float64Var(&steady_max, "steady-max", 0, "Keep object modes that aren't steady at the end of -d running for up to this many seconds")
+	myflag.StringVar(&soak_prefix, "soak", "", "Soak test, streaming the results to files starting with this prefix.  See NOTES for more info")
+	myflag.Float64Var(&soak_period, "soak-period", 3600, "Number of seconds summarized by each row of a soak test summary")
+	myflag.StringVar(&soakRotateArg, "soak-rotate", "64M", "Size at which the soak test interval files are rotated")
+	myflag.Float64Var(&rampup_secs, "rampup", 0, "Number of seconds over which the threads of the object modes are started, not counting their ops")
+	myflag.Float64Var(&request_timeout, "timeout", 0, "Number of seconds a request may take, including reading the response body, 0 for no timeout")
+	myflag.IntVar(&retries, "retries", 3, "Number of times a failed request is retried before the op fails")
+	myflag.IntVar(&max_errors, "max-errors", 3, "Number of failed ops after which a thread gives up <-1 for unlimited>")
 	myflag.BoolVar(&zero_object_data, "zd", false, "Write zero values for objects data in PUT operations instead of random data")
+	myflag.Float64Var(&head_miss_ratio, "hmr", 0.0, "Fraction of HEAD requests that target non-existent keys (0.0 - 1.0)")
+	myflag.StringVar(&copy_dest, "cd", "same", "Destination bucket for copies <same, cross>")
+	myflag.StringVar(&copy_key_select, "cks", "seq", "Source key selection for copies <seq, rand>")
+	myflag.BoolVar(&copy_replace_metadata, "cmr", false, "Replace object metadata on copy instead of copying it from the source")
+	myflag.StringVar(&copyPartSizeArg, "cps", "0", "Copy objects larger than this with UploadPartCopy in parts of this size <0 to disable>")
 	// define custom usage output with notes
 	notes :=
 		`
 NOTES:
   - Valid mode types for the -m mode string are:
-    c: clear all existing objects from buckets (requires lookups)
-    x: delete buckets
+    c: clear existing objects from buckets (requires lookups, uses
+       batch deletes from all threads, see -clear-all and -clear-dry-run)
+    x: delete buckets (aborts leftover multipart uploads first)
     i: initialize buckets 
     p: put objects in buckets
     l: list objects in buckets
     g: get objects from buckets
+    h: head objects in buckets (see -hmr for negative lookups)
+    y: copy objects server-side (see -cd, -cks, -cmr and -cps)
     d: delete objects from buckets 
+    b: batch delete objects from buckets with DeleteObjects (see -bds)
+    v: put "-nv" versions of every object in buckets (see -ver)
+    r: get random versions written by an earlier "v" test
+    o: list object versions and delete markers in buckets
+    k: delete every version written by an earlier "v" test by version ID
 
     These modes are processed in-order and can be repeated, ie "ippgd" will
     initialize the buckets, put the objects, reput the objects, get the
     objects, and then delete the objects.  The repeat flag will repeat this
     whole process the specified number of times.
 
+    Modes can be separated by commas and followed by [name=value,...] to
+    run them with other parameters than the flags, i.e.
+    "i,p[t=64,z=4K,d=300],g[t=128],d".  The names are t, z, d and n for
+    the threads, size, duration and count of the flags of the same name,
+    and keys, rate, repeat, warmup and rampup as described for workload
+    files below.  Only d, warmup and rampup can be 0.
+
+  - "-w" runs the stages of a workload file instead of the "-m" modes.
+    Each stage runs one mode ("op") or a weighted "mix" of the p, g, h, y,
+    v, r, k and d modes, with its own "threads", "size", "duration",
+    "count" (ops to run instead of "-n"), "keys" (the object numbers
+    "first-last" to address, in a loop), "rate" (ops/s over all threads),
+    "repeat", and "warmup" and "rampup" like the flags.  Whatever a stage
+    leaves out is taken from "defaults", and then from the flags, while a
+    "duration", "warmup" or "rampup" of 0 is kept.  "${name}" is replaced
+    by the environment variable or else the "vars" entry of that name.  Files ending in .json are read as JSON, everything else as
+    YAML:
+
+      vars:
+        size: 4K
+      defaults:
+        threads: 32
+        size: ${size}
+      stages:
+        - op: i
+        - op: p
+          count: 100000
+        - name: mixed
+          mix: {g: 80, p: 20}
+          keys: 0-99999
+          rate: 2000
+          duration: 300
+        - op: c
+        - op: x
+
+    The stages are logged before the run starts.  "-l" repeats all of
+    them.
+
+  - "-rampup" starts the threads of every object mode one by one over the
+    given number of seconds, and "-warmup" then runs them all for that
+    many more seconds before any ops are counted.  Both come on top of
+    "-d", and the modes log a WARMUP row with the ops that finished before
+    counting began, which the TOTAL row and the intervals leave out.  Ops
+    of the warm-up still count against "-n".  A mode that ends during the
+    warm-up has no TOTAL row.  The bucket modes never ramp up or warm up.
+
+  - "-steady N" watches the intervals of the object modes for a steady
+    state, where the IO/s and the average latency of the last N intervals
+    of every stream stay within "-steady-cv" (a coefficient of variation,
+    0.05 by default) of their mean.  The first such window is logged, grows
+    for as long as the mode stays steady, and gets a STEADY row next to
+    the TOTAL row.  "-steady-stop" ends the mode as soon as it is steady
+    instead of running for all of "-d", and "-steady-max" keeps a mode that
+    isn't steady by the end of "-d" running until it is, for up to that
+    many seconds in all.
+
+  - "-soak PREFIX" is for tests that run for hours or days.  The interval
+    rows are written to PREFIX-intervals-000.csv as they come in, moving on
+    to the next number whenever a file grows past "-soak-rotate", and are
+    left out of "-o" and "-j".  Every "-soak-period" seconds (an hour by
+    default) the modes log a summary row named P1, P2 and so on, which is
+    also written to PREFIX-summary.csv.  At the end of every mode a soak
+    report compares the last full period to the first one, and calls the
+    mode DEGRADED if its IO/s fell or its 99% latency rose by more than
+    10%.  Latencies go into histograms with a resolution of about 1.5%
+    instead of being kept one by one, and intervals are dropped once they
+    are written, so memory use stays flat however long the test runs.
+
+  - "-o" and "-j" get every interval and TOTAL row as soon as it is
+    logged, as CSV rows and as JSON Lines (one JSON object per line), so
+    that they can be followed while the run goes on.  The CSV file is
+    flushed every second and both are flushed when hsbench is interrupted.
+    Existing files are overwritten, unless "-append" adds to them, in which
+    case a CSV header is only written to an empty file.
+
+  - The lines of a "-j" file for a run start with a "hsbench.run/1" record
+    describing it: a unique RunID, the hsbench version, the start time,
+    the host name, OS, kernel, CPU count and Go version, the "-tag"
+    name=value pairs, the value every flag but the access and secret keys
+    ended up with, the seed and the stages that were run.  The result rows
+    follow, and a "hsbench.end/1" record with the same RunID ends the run
+    with its end time and a Status of completed or interrupted.  The object
+    data, mixes, HEAD misses, copy sources and random list prefixes all
+    follow from the seed, so "-seed" repeats them.
+
+  - "-metrics-listen" serves the run on /metrics in the Prometheus text
+    format, to graph it live next to the server.  hsbench_ops_total,
+    hsbench_bytes_total, hsbench_errors_total and the
+    hsbench_op_latency_seconds histogram count the requests as they are
+    added to the results, retries included in the errors, with mode (the
+    -m letter), op (the result name, i.e. HEADMISS), bucket and endpoint
+    labels.  Like the TOTAL row they leave out the ops of the "-warmup".
+    Errors are counted by class: timeout, throttled (503 or SlowDown),
+    client (other 4xx), server (other 5xx) and other.  The
+    hsbench_inflight_requests and hsbench_running_threads gauges follow
+    the requests being sent and the threads of the running stage.
+
+  - Object sizes ("-z" and "size") can be a single size, a "min-max"
+    range, or a comma separated list of those with ":weight" suffixes, i.e.
+    "4K-64K:90,1M:10".  The size of every object is derived from its
+    number, so stages with the same sizes agree on them.
+
+  - "-sweep name=value,..." runs the modes once for every value of
+    threads, size, buckets or rate, in the order given, i.e.
+    "-sweep threads=1,2,4,8".  Every result row gets the point it belongs
+    to in the Sweep column, and the TOTAL rows of all points are logged
+    again as a "Sweep summary" at the end.  Bucket setup (c, x and i) at
+    the start of the modes only runs for the first point and bucket
+    teardown (c and x) at the end only for the last, so the buckets and
+    objects carry over, except when sweeping buckets.  The threads, size
+    and rate only apply to the object modes.  Size values can be ranges
+    but not lists, since the commas separate the points.
+
+  - "-search" looks for the highest thread count or rate in a range, i.e.
+    "threads=1-256" or "rate=100-20000", at which the modes stay within
+    the "-slo" limits, i.e. "p99<50ms,errors<0.1%".  The latency limit
+    applies to the given percentile of every mode, and the error limit to
+    the share of requests that failed, counting every failed attempt.
+    Starting from the bottom of the range, the modes run with double the
+    value each step until they miss the limits or reach the top, then the
+    last passing and first failing values are bisected down to one thread
+    or 5% of the rate.  A step with a rate also fails if a mode falls more
+    than 10% short of it.  Every step is logged as it finishes, followed by
+    the whole trajectory and the result at the end, and its rows are
+    marked with the step in the Sweep column.  Keep the steps short with
+    "-d".  Bucket setup and teardown run once around the search, like for
+    "-sweep".
+
+  - Object keys are built from the object prefix and a 12 digit sequence
+    number according to the "-kl" key layout:
+      flat:     <prefix>000000000123
+      tree:     <prefix>a/b/c/000000000123, with "-kd" levels of "-kf"
+                entries each and "-kpl" objects in every leaf directory
+      hash:     <prefix>3f2a/000000000123, with "-khl" hash characters
+      template: <prefix> followed by "-kt" with {client}, {thread}, {seq}
+                and {rand} replaced.  {thread} is the sequence number
+                modulo "-t" and {rand} is derived from the sequence number,
+                so every mode generates the same key for the same object.
+
+  - Copies are written next to their source as <key>.copy, either in the
+    same bucket or, with "-cd cross", in the next bucket of the run.  They
+    are removed by the "c" mode but not by "d".
+
   - When performing bucket listings, many S3 storage systems limit the
     maximum number of keys returned to 1000 even if MaxKeys is set higher.
     hsbench will attempt to set MaxKeys to whatever value is passed via the 
     "mk" flag, but it's likely that any values above 1000 will be ignored.
+
+  - "-driver raw" sends object PUT, GET, HEAD and DELETE requests straight
+    over HTTP with a built-in V2 or V4 signer instead of aws-sdk-go, which
+    costs a lot less client CPU for small objects.  This includes the
+    versioned requests of the "v", "r" and "k" modes.  All other requests
+    still go through aws-sdk-go.
+
+  - GET throughput is computed from the bytes actually received, so short
+    reads show up as a lower MB/s.  A body that ends before its
+    Content-Length fails the request.
+
+  - A request that timed out, lost its connection, was throttled (503,
+    SlowDown or 429) or hit a server error is retried up to "-retries"
+    times with a short randomized backoff, and every attempt gets
+    "-timeout" seconds to finish.  Other errors, i.e. 403 or 404, fail the
+    request right away.  Every failed attempt is counted as a slowdown, and the latency
+    of a request that succeeded after retrying includes the failed attempts.
+    A thread gives up after "-max-errors" requests failed every retry,
+    except in the bucket modes.  aws-sdk-go's own retries are disabled.
+    Bucket listings are never retried and have no timeout.
+
+  - "hsbench proxy -target URL" forwards S3 requests to URL and injects
+    faults, to see how the results respond to a degraded gateway.
+    "-latency" and "-jitter" delay every request, while "-slowdown",
+    "-reset", "-truncate" and "-stall" give the fraction of requests that
+    get a 503 SlowDown, a reset connection, a response body cut off halfway
+    or one held for "-stall-time" halfway.  The proxy listens on
+    127.0.0.1:9001 unless "-listen" says otherwise, passes the Host header
+    through so signatures still match, and logs the faults it injected
+    every 10 seconds.  "-target mem://" puts it in front of a built-in
+    mem:// server.
+
+  - With "-u file:///some/dir" the same modes run against a filesystem
+    instead of S3: buckets are directories under /some/dir and objects are
+    files, with every "/" in a key making a subdirectory.  GET latency is
+    the time to open the file, like it is the time to the response headers
+    for S3.  "-fsync" syncs every PUT and copy before it counts as done and
+    "-odirect" bypasses the page cache (object sizes must then be a
+    multiple of 4K).  Versioning, SSE and the raw driver are not available.
+
+  - "-u mem://" starts an in-memory S3 stand-in inside hsbench on a
+    loopback port and runs against it, with either driver and any access
+    keys.  It implements every request hsbench sends, including versioning,
+    multipart copies and aws-chunked uploads, but checks no signatures.
+    With "-discard" it only remembers object sizes and GETs return zeroes,
+    so the results show what the client itself can do.  Keep in mind that
+    the CPU(us/op) figures then include the server.  "hsbench serve
+    [-listen addr] [-discard]" runs the same server on its own, for clients
+    on other machines or other tools.
+
+  - PUT payloads are sent unsigned by default.  "-ps signed" has the
+    signature cover a SHA256 of the whole body, and "-ps streaming" sends
+    SigV4 signed aws-chunked uploads.  "-ck" adds a Content-MD5 or
+    x-amz-checksum-* header, or with "-ckt" an aws-chunked trailer (signed
+    when "-ps" is signed or streaming).  Checksums are computed for every
+    request so that their client CPU cost, reported as CPU(us/op) on the
+    TOTAL line of every test, can be compared.
+
+  - With "-sse" every PUT, GET, HEAD and copy carries the server side
+    encryption headers for the chosen mode.  SSE-C keys are only accepted
+    over https:// endpoints.  Unless "-sse-c-key" is given a new key is
+    generated for every run and logged, so it can be passed to a later run
+    that reads the same objects.
+
+  - Versioning is enabled on the buckets during "i" with "-ver".  The plain
+    delete test ("d") does not pass version IDs, so on a versioned bucket it
+    creates delete markers, while "k" permanently removes the versions
+    written by "v".  Bucket clears purge every version and delete marker.
+
+  - Bucket clears ("c") and deletes ("x") abort any incomplete multipart
+    uploads left behind by interrupted runs and report how many they found.
+
+  - Bucket clears ("c") only delete objects under the object prefix.
+    Before deleting anything they list every bucket, and refuse to continue
+    if any of them holds an object under that prefix that doesn't match
+    the key layout, since it wasn't created by hsbench.  Nothing is deleted
+    then, in any bucket.  Use "-clear-all" to delete every object
+    regardless, and "-clear-dry-run" to only log the objects, multipart
+    uploads and buckets that "c" and "x" would delete.
+
+  - Batch deletes ("b") and bucket clears ("c") count every DeleteObjects
+    call as one op and report the number of keys removed as Keys and
+    Keys/s.  Bucket clears list all buckets in parallel and share the
+    resulting batches between all threads.  Batch deletes remove the
+    objects up to "-n", or those written by an earlier p or v stage, and
+    can't be run without either.
+
+  - Every page of a bucket listing is counted as one op.  The keys and
+    common prefixes returned are reported as Keys and Keys/s.  With "-lc"
+    greater than 1, that many threads list each bucket at once, so "-t"
+    should be at least "-b" times "-lc" for them to actually overlap.
 `
 	myflag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "\nUSAGE: %s [OPTIONS]\n\n", os.Args[0])
 		fmt.Fprintf(flag.CommandLine.Output(), "OPTIONS:\n")
 		myflag.PrintDefaults()
-		fmt.Fprintf(flag.CommandLine.Output(), notes)
+		fmt.Fprint(flag.CommandLine.Output(), notes)
 	}
 
 	if err := myflag.Parse(os.Args[1:]); err != nil {
@@ -876,52 +1827,245 @@ NOTES:
 	}
 
 	// Check the arguments
-	if object_count < 0 && duration_secs < 0 {
+	if workload != "" {
+		myflag.Visit(func(f *flag.Flag) {
+			if f.Name == "m" {
+				log.Fatal("A workload file (-w) replaces the modes passed to -m, only use one of them")
+			}
+		})
+	} else if object_count < 0 && duration_secs < 0 {
 		log.Fatal("The number of objects and duration can not both be unlimited")
 	}
-	if access_key == "" {
+	if request_timeout < 0 {
+		log.Fatal("The request timeout passed to -timeout can not be negative")
+	}
+	if warmup_secs < 0 || rampup_secs < 0 {
+		log.Fatal("The -warmup and -rampup arguments can not be negative")
+	}
+	if steady_intervals > 0 && interval <= 0 {
+		log.Fatal("Looking for a steady state with -steady needs report intervals, -ri must be positive")
+	}
+	if steady_intervals > 0 && steady_intervals < 2 {
+		log.Fatal("The -steady argument needs at least 2 intervals to compare")
+	}
+	if steady_cv <= 0 || steady_max < 0 {
+		log.Fatal("The -steady-cv argument must be positive and -steady-max can not be negative")
+	}
+	if soak_prefix != "" {
+		if interval <= 0 {
+			log.Fatal("A soak test needs report intervals, -ri must be positive")
+		}
+		if steady_intervals > 0 {
+			log.Fatal("A soak test can't look for a steady state, -soak and -steady can't be used together")
+		}
+		if soak_period < interval {
+			log.Fatal("The -soak-period argument must be at least one report interval")
+		}
+		size, err := bytefmt.ToBytes(soakRotateArg)
+		if err != nil {
+			log.Fatalf("Invalid -soak-rotate argument for file size: %v", err)
+		}
+		soak_rotate = int64(size)
+	}
+	if retries < 0 {
+		log.Fatal("The number of retries passed to -retries can not be negative")
+	}
+	if max_errors < 1 && max_errors != -1 {
+		log.Fatal("The number of errors passed to -max-errors must be at least 1, or -1 for unlimited")
+	}
+	if head_miss_ratio < 0 || head_miss_ratio > 1 {
+		log.Fatal("The HEAD miss ratio passed to -hmr must be between 0.0 and 1.0")
+	}
+	if copy_dest != "same" && copy_dest != "cross" {
+		log.Fatal("Invalid -cd argument for copy destination, must be same or cross")
+	}
+	if copy_dest == "cross" && bucket_count < 2 {
+		log.Fatal("Copies to the next bucket with -cd cross need at least 2 buckets, -b must be 2 or more")
+	}
+	if copy_key_select != "seq" && copy_key_select != "rand" {
+		log.Fatal("Invalid -cks argument for copy key selection, must be seq or rand")
+	}
+	if list_version != 1 && list_version != 2 {
+		log.Fatal("Invalid -lv argument for list version, must be 1 or 2")
+	}
+	if list_concurrency < 1 {
+		log.Fatal("The number of listers per bucket passed to -lc must be at least 1")
+	}
+	if list_random_prefix < 0 {
+		log.Fatal("The number of digits passed to -lrp can not be negative")
+	}
+	switch key_layout {
+	case "flat", "hash", "template":
+	case "tree":
+		if key_depth < 1 || key_fanout < 1 || key_per_leaf < 1 {
+			log.Fatal("The -kd, -kf and -kpl arguments for the tree key layout must be at least 1")
+		}
+	default:
+		log.Fatal("Invalid -kl argument for key layout, must be flat, tree, hash or template")
+	}
+	if key_layout == "hash" && (key_hash_len < 1 || key_hash_len > 32) {
+		log.Fatal("The hash length passed to -khl must be between 1 and 32")
+	}
+	if key_layout == "template" && !strings.Contains(key_template, "{seq}") {
+		log.Fatal("The key template passed to -kt must contain {seq} to keep keys unique")
+	}
+	if key_client == "" {
+		key_client, _ = os.Hostname()
+	}
+	if versions_per_key < 1 {
+		log.Fatal("The number of versions passed to -nv must be at least 1")
+	}
+	switch sse_mode {
+	case "", "AES256", "aws:kms":
+	case "SSE-C":
+		if sseCKeyArg == "" {
+			key := make([]byte, 32)
+			crand.Read(key)
+			sseCKeyArg = base64.StdEncoding.EncodeToString(key)
+			log.Printf("Generated SSE-C key %s, pass it with -sse-c-key to read these objects in later runs", sseCKeyArg)
+		}
+		key, err := base64.StdEncoding.DecodeString(sseCKeyArg)
+		if err != nil || len(key) != 32 {
+			log.Fatal("The SSE-C key passed to -sse-c-key must be 32 bytes, base64 encoded")
+		}
+		sse_c_key = string(key)
+		sum := md5.Sum(key)
+		sse_c_key_b64 = sseCKeyArg
+		sse_c_key_md5 = base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		log.Fatal("Invalid -sse argument for server side encryption, must be AES256, aws:kms or SSE-C")
+	}
+	if driver != "sdk" && driver != "raw" {
+		log.Fatal("Invalid -driver argument, must be sdk or raw")
+	}
+	if strings.HasPrefix(url_host, "file://") {
+		if driver == "raw" {
+			log.Fatal("The raw driver needs an http:// or https:// URL passed to -u")
+		}
+		if sse_mode != "" {
+			log.Fatal("Server side encryption (-sse) needs an S3 endpoint, not a file:// URL")
+		}
+		driver = "file"
+	} else if file_fsync || file_odirect {
+		log.Fatal("The -fsync and -odirect options only apply to file:// URLs")
+	}
+	if strings.HasPrefix(url_host, "mem://") {
+		// The mem:// server accepts any credentials
+		if access_key == "" {
+			access_key = "hsbench"
+		}
+		if secret_key == "" {
+			secret_key = "hsbench"
+		}
+	} else if mem_discard {
+		log.Fatal("The -discard option only applies to mem:// URLs")
+	}
+	if file_odirect && oDirect == 0 {
+		log.Fatal("O_DIRECT (-odirect) is only supported on Linux")
+	}
+	if signature_version != "v2" && signature_version != "v4" {
+		log.Fatal("Invalid -sig argument for the raw driver signature, must be v2 or v4")
+	}
+	if driver == "raw" && (payload_signing != "unsigned" || payload_trailer) {
+		log.Fatal("The raw driver only sends unsigned payloads, -ps and -ckt need -driver sdk")
+	}
+	if payload_signing != "unsigned" && payload_signing != "signed" && payload_signing != "streaming" {
+		log.Fatal("Invalid -ps argument for payload signing, must be unsigned, signed or streaming")
+	}
+	switch payload_checksum {
+	case "none", "md5", "crc32", "crc32c", "sha1", "sha256":
+	default:
+		log.Fatal("Invalid -ck argument for checksum, must be none, md5, crc32, crc32c, sha1 or sha256")
+	}
+	if payload_trailer && (payload_checksum == "none" || payload_checksum == "md5") {
+		log.Fatal("Trailing checksums (-ckt) need one of the crc32, crc32c, sha1 or sha256 checksums")
+	}
+	if batch_delete_size < 1 || batch_delete_size > 1000 {
+		log.Fatal("The batch size passed to -bds must be between 1 and 1000")
+	}
+	if access_key == "" && driver != "file" {
 		log.Fatal("Missing argument -a for access key.")
 	}
-	if secret_key == "" {
+	if secret_key == "" && driver != "file" {
 		log.Fatal("Missing argument -s for secret key.")
 	}
 	if url_host == "" {
 		log.Fatal("Missing argument -u for host endpoint.")
 	}
-	invalid_mode := false
-	for _, r := range modes {
-		if r != 'i' &&
-			r != 'c' &&
-			r != 'p' &&
-			r != 'g' &&
-			r != 'l' &&
-			r != 'd' &&
-			r != 'x' {
-			s := fmt.Sprintf("Invalid mode '%s' passed to -m", string(r))
-			log.Printf(s)
-			invalid_mode = true
+	plan = makePlan()
+	object_size = 0
+	for _, st := range plan {
+		if size := st.sizes.max(); size > object_size {
+			object_size = size
+		}
+	}
+	if sweepArg != "" {
+		if err := parseSweep(sweepArg); err != nil {
+			log.Fatalf("Invalid -sweep argument: %v", err)
 		}
 	}
-	if invalid_mode {
-		log.Fatal("Invalid modes passed to -m, see help for details.")
+	if (searchArg == "") != (sloArg == "") {
+		log.Fatal("The -search and -slo arguments have to be used together")
 	}
-	var err error
-	var size uint64
-	if size, err = bytefmt.ToBytes(sizeArg); err != nil {
-		log.Fatalf("Invalid -z argument for object size: %v", err)
+	if searchArg != "" {
+		if sweepArg != "" {
+			log.Fatal("The -search and -sweep arguments can't be used together")
+		}
+		if err := parseSLO(sloArg); err != nil {
+			log.Fatalf("Invalid -slo argument: %v", err)
+		}
+		if err := parseSearch(searchArg); err != nil {
+			log.Fatalf("Invalid -search argument: %v", err)
+		}
+	}
+	// Version IDs are only known to the run that wrote them
+	if first := strings.IndexAny(planModes(), "rk"); first >= 0 && !strings.ContainsRune(planModes()[:first], 'v') {
+		log.Fatal("The r and k modes need an earlier v mode to write the versions they use")
+	}
+	keygen = makeKeyGen(key_layout, object_prefix, key_depth, key_fanout, key_per_leaf, key_hash_len, key_template, key_client, int64(threads))
+	if copyPartSizeArg != "0" {
+		size, err := bytefmt.ToBytes(copyPartSizeArg)
+		if err != nil {
+			log.Fatalf("Invalid -cps argument for copy part size: %v", err)
+		}
+		copy_part_size = int64(size)
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return myflag
+}
+
+// makeBuckets -- set up the names of the bucket_count buckets
+func makeBuckets() {
+	buckets = nil
+	for i := int64(0); i < bucket_count; i++ {
+		buckets = append(buckets, fmt.Sprintf("%s%012d", bucket_prefix, i))
+	}
+}
+
+// runPlan -- run every stage, as often as it is repeated
+func runPlan(loop int, stages []*Stage) []OutputStats {
+	oStats := make([]OutputStats, 0)
+	for _, st := range stages {
+		for rep := 0; rep < st.Repeat; rep++ {
+			oStats = append(oStats, runWrapper(loop, st)...)
+		}
 	}
-	object_size = int64(size)
+	return oStats
 }
 
 func initData() {
-	// Initialize data for the bucket
-	object_data = make([]byte, object_size)
+	// Initialize data for the bucket, aligned so that it can be written
+	// with O_DIRECT.  It is as large as the largest object of the plan and
+	// smaller objects use the start of it.
+	object_data = alignedBuffer(object_size)
 	if zero_object_data {
 		for i := range object_data {
 			object_data[i] = 0
 		}
 	} else {
-		rand.Read(object_data)
+		rand.New(rand.NewSource(seed)).Read(object_data)
 	}
 	hasher := md5.New()
 	hasher.Write(object_data)
@@ -929,28 +2073,92 @@ func initData() {
 }
 
 func main() {
+	flags := parseArgs()
+
 	// Hello
-	log.Printf("Hotsauce S3 Benchmark Version 0.1")
+	log.Printf("Hotsauce S3 Benchmark Version %s", version)
 
-	cfg = &aws.Config{
-		Endpoint:    aws.String(url_host),
-		Credentials: credentials.NewStaticCredentials(access_key, secret_key, ""),
-		Region:      aws.String(region),
-		// DisableParamValidation:  aws.Bool(true),
-		DisableComputeChecksums: aws.Bool(true),
-		S3ForcePathStyle:        aws.Bool(true),
+	switch subcommand {
+	case "serve":
+		runServe(os.Args[2:])
+		return
+	case "proxy":
+		runProxy(os.Args[2:])
+		return
+	}
+	if strings.HasPrefix(url_host, "mem://") {
+		url_host = startMemServer(mem_discard)
+		log.Printf("Started the mem:// server on %s", url_host)
 	}
+	backend = makeDriver()
+	if _, ok := backend.(Copier); !ok && strings.ContainsRune(planModes(), 'y') {
+		log.Fatalf("The %s driver can't copy objects, remove y from -m", driver)
+	}
+	if _, ok := backend.(Versioner); !ok && (versioning || strings.ContainsAny(planModes(), "vrok")) {
+		log.Fatalf("The %s driver doesn't support versioning, -ver and the v, r, o and k modes can't be used", driver)
+	}
+
+	makeRunInfo(flags)
 
 	// Echo the parameters
 	log.Printf("Parameters:")
+	log.Printf("run_id=%s", run_info.RunID)
+	log.Printf("seed=%d", seed)
+	if len(tags) > 0 {
+		log.Printf("tags=%s", tags)
+	}
 	log.Printf("url=%s", url_host)
 	log.Printf("object_prefix=%s", object_prefix)
 	log.Printf("bucket_prefix=%s", bucket_prefix)
+	log.Printf("key_layout=%s", key_layout)
+	switch key_layout {
+	case "tree":
+		log.Printf("key_depth=%d key_fanout=%d key_per_leaf=%d", key_depth, key_fanout, key_per_leaf)
+	case "hash":
+		log.Printf("key_hash_len=%d", key_hash_len)
+	case "template":
+		log.Printf("key_template=%s key_client=%s", key_template, key_client)
+	}
 	log.Printf("region=%s", region)
-	log.Printf("modes=%s", modes)
+	if workload != "" {
+		log.Printf("workload=%s", workload)
+	} else {
+		log.Printf("modes=%s", modes)
+	}
 	log.Printf("output=%s", output)
 	log.Printf("json_output=%s", json_output)
+	log.Printf("append=%t", output_append)
 	log.Printf("max_keys=%d", max_keys)
+	log.Printf("list_version=%d", list_version)
+	log.Printf("list_prefix=%s", list_prefix)
+	log.Printf("list_delimiter=%s", list_delimiter)
+	log.Printf("list_start_after=%s", list_start_after)
+	log.Printf("list_random_prefix=%d", list_random_prefix)
+	log.Printf("list_concurrency=%d", list_concurrency)
+	log.Printf("batch_delete_size=%d", batch_delete_size)
+	log.Printf("driver=%s", driver)
+	if driver == "raw" {
+		log.Printf("signature_version=%s", signature_version)
+	}
+	if driver == "file" {
+		log.Printf("fsync=%t", file_fsync)
+		log.Printf("odirect=%t", file_odirect)
+	}
+	log.Printf("payload_signing=%s", payload_signing)
+	log.Printf("payload_checksum=%s", payload_checksum)
+	log.Printf("payload_trailer=%t", payload_trailer)
+	log.Printf("sse=%s", sse_mode)
+	if sse_mode == "aws:kms" {
+		log.Printf("sse_kms_key_id=%s", sse_kms_key_id)
+	}
+	if sse_mode == "SSE-C" {
+		sum := md5.Sum([]byte(sse_c_key))
+		log.Printf("sse_c_key_md5=%s", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	log.Printf("versioning=%t", versioning)
+	log.Printf("versions_per_key=%d", versions_per_key)
+	log.Printf("clear_all=%t", clear_all)
+	log.Printf("clear_dry_run=%t", clear_dry_run)
 	log.Printf("object_count=%d", object_count)
 	log.Printf("bucket_count=%d", bucket_count)
 	log.Printf("duration=%d", duration_secs)
@@ -958,56 +2166,112 @@ func main() {
 	log.Printf("loops=%d", loops)
 	log.Printf("size=%s", sizeArg)
 	log.Printf("interval=%f", interval)
+	log.Printf("warmup=%f", warmup_secs)
+	log.Printf("rampup=%f", rampup_secs)
+	if steady_intervals > 0 {
+		log.Printf("steady=%d steady_cv=%f steady_stop=%t steady_max=%f", steady_intervals, steady_cv, steady_stop, steady_max)
+	}
+	if soak_prefix != "" {
+		log.Printf("soak=%s soak_period=%f soak_rotate=%s", soak_prefix, soak_period, soakRotateArg)
+	}
+	log.Printf("timeout=%f", request_timeout)
+	log.Printf("retries=%d", retries)
+	log.Printf("max_errors=%d", max_errors)
+	log.Printf("head_miss_ratio=%f", head_miss_ratio)
+	log.Printf("copy_dest=%s", copy_dest)
+	log.Printf("copy_key_select=%s", copy_key_select)
+	log.Printf("copy_replace_metadata=%t", copy_replace_metadata)
+	log.Printf("copy_part_size=%s", copyPartSizeArg)
+	log.Printf("Stages:")
+	maxThreads := 0
+	for i, st := range plan {
+		log.Printf("%d: %s", i+1, st)
+		if st.Threads > maxThreads {
+			maxThreads = st.Threads
+		}
+	}
+	if sweepArg != "" {
+		log.Printf("sweep=%s", sweepArg)
+		if sweep_param == "threads" {
+			for _, v := range sweep_values {
+				if t, _ := strconv.Atoi(v); t > maxThreads {
+					maxThreads = t
+				}
+			}
+		}
+	}
+	if searchArg != "" {
+		log.Printf("search=%s", searchArg)
+		log.Printf("slo=%s", sloArg)
+		if search_param == "threads" && int(search_max) > maxThreads {
+			maxThreads = int(search_max)
+		}
+	}
+
+	// Keep enough idle connections around for every thread
+	if t, ok := HTTPTransport.(*http.Transport); ok {
+		t.MaxIdleConnsPerHost = 2 * maxThreads
+		t.MaxIdleConns = 2 * maxThreads
+	}
 
 	// Init Data
 	initData()
 
-	// Setup the slice of buckets
-	for i := int64(0); i < bucket_count; i++ {
-		buckets = append(buckets, fmt.Sprintf("%s%012d", bucket_prefix, i))
+	if metrics_listen != "" {
+		serveMetrics()
+	}
+
+	// Results are written as they come in, and soak tests stream theirs
+	// to files of their own, so close them all with what there is if the
+	// run is interrupted
+	openResults()
+	if soak_prefix != "" {
+		makeSoakFiles()
+		defer closeSoakFiles()
 	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupted
+		closeResults("interrupted")
+		closeSoakFiles()
+		log.Fatalf("Stopped by %v", sig)
+	}()
+
+	// Setup the slice of buckets
+	makeBuckets()
 
 	// Loop running the tests
 	oStats := make([]OutputStats, 0)
 	for loop := 0; loop < loops; loop++ {
-		for _, r := range modes {
-			oStats = append(oStats, runWrapper(loop, r)...)
+		if searchArg != "" {
+			oStats = append(oStats, runSearch(loop)...)
+			continue
 		}
-	}
-
-	// Write CSV Output
-	if output != "" {
-		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY, 0777)
-		defer file.Close()
-		if err != nil {
-			log.Fatal("Could not open CSV file for writing.")
-		} else {
-			csvWriter := csv.NewWriter(file)
-			for i, o := range oStats {
-				if i == 0 {
-					o.csv_header(csvWriter)
-				}
-				o.csv(csvWriter)
+		if sweepArg == "" {
+			oStats = append(oStats, runPlan(loop, plan)...)
+			continue
+		}
+		for p, value := range sweep_values {
+			sweep_point = sweep_param + "=" + value
+			log.Printf("Running Loop %d sweep point %s", loop, sweep_point)
+			if sweep_param == "buckets" {
+				bucket_count, _ = strconv.ParseInt(value, 10, 64)
+				makeBuckets()
 			}
-			csvWriter.Flush()
+			oStats = append(oStats, runPlan(loop, sweepStages(value, p == 0, p == len(sweep_values)-1))...)
 		}
 	}
 
-	// Write JSON output
-	if json_output != "" {
-		file, err := os.OpenFile(json_output, os.O_CREATE|os.O_WRONLY, 0777)
-		defer file.Close()
-		if err != nil {
-			log.Fatal("Could not open JSON file for writing.")
-		}
-		data, err := json.Marshal(oStats)
-		if err != nil {
-			log.Fatal("Error marshaling JSON: ", err)
-		}
-		_, err = file.Write(data)
-		if err != nil {
-			log.Fatal("Error writing to JSON file: ", err)
+	// One line per mode and sweep point to compare them
+	if sweepArg != "" {
+		log.Printf("Sweep summary:")
+		for _, o := range oStats {
+			if o.IntervalName == "TOTAL" {
+				o.log()
+			}
 		}
-		file.Sync()
 	}
+
+	closeResults("completed")
 }
@@ -0,0 +1,114 @@
+// keys.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// KeyGen turns op numbers into object names.  Every mode that touches
+// objects goes through the same generator so that keys written by a PUT
+// test can be found again by the GET, HEAD, COPY and DEL tests.
+type KeyGen struct {
+	// Key layout: flat, tree, hash or template
+	layout string
+	// Prefix put in front of every key
+	prefix string
+	// Tree layout: number of directory levels and entries per level
+	depth  int
+	fanout int64
+	// Tree layout: number of objects in each leaf directory
+	perLeaf int64
+	// Hash layout: number of hex characters in the leading hash
+	hashLen int
+	// Template layout: name with {client}, {thread}, {seq} and {rand}
+	template string
+	client   string
+	threads  int64
+	// Matches every name this generator can produce
+	re *regexp.Regexp
+}
+
+func makeKeyGen(layout string, prefix string, depth int, fanout int64, perLeaf int64, hashLen int, template string, client string, threads int64) KeyGen {
+	kg := KeyGen{layout, prefix, depth, fanout, perLeaf, hashLen, template, client, threads, nil}
+	seq := `[0-9]{12}`
+	var name string
+	switch layout {
+	case "tree":
+		name = fmt.Sprintf(`([a-z]+/){%d}%s`, depth, seq)
+	case "hash":
+		name = fmt.Sprintf(`[0-9a-f]{%d}/%s`, hashLen, seq)
+	case "template":
+		r := strings.NewReplacer(
+			regexp.QuoteMeta("{client}"), regexp.QuoteMeta(client),
+			regexp.QuoteMeta("{thread}"), `[0-9]+`,
+			regexp.QuoteMeta("{seq}"), seq,
+			regexp.QuoteMeta("{rand}"), `[0-9a-f]{8}`)
+		name = r.Replace(regexp.QuoteMeta(template))
+	default:
+		name = seq
+	}
+	// Copies are stored next to their source with a .copy suffix
+	kg.re = regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + name + `(\.copy)?$`)
+	return kg
+}
+
+// dirName -- name the i'th entry of a tree level a, b, ..., z, ba, bb, ...
+func dirName(i int64) string {
+	name := []byte{}
+	for {
+		name = append([]byte{byte('a' + i%26)}, name...)
+		i /= 26
+		if i == 0 {
+			break
+		}
+	}
+	return string(name)
+}
+
+// keyRand -- a stable pseudo random value for an op so that {rand} expands
+// to the same thing every time the same object is addressed
+func keyRand(objnum int64) string {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.FormatInt(objnum, 10)))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func (kg *KeyGen) key(objnum int64) string {
+	seq := fmt.Sprintf("%012d", objnum)
+	switch kg.layout {
+	case "tree":
+		// Walk up from the leaf; the top level takes whatever is left
+		leaf := objnum / kg.perLeaf
+		dirs := make([]string, kg.depth)
+		for l := kg.depth - 1; l > 0; l-- {
+			dirs[l] = dirName(leaf % kg.fanout)
+			leaf /= kg.fanout
+		}
+		dirs[0] = dirName(leaf)
+		return kg.prefix + strings.Join(dirs, "/") + "/" + seq
+	case "hash":
+		sum := md5.Sum([]byte(seq))
+		return kg.prefix + hex.EncodeToString(sum[:])[:kg.hashLen] + "/" + seq
+	case "template":
+		r := strings.NewReplacer(
+			"{client}", kg.client,
+			"{thread}", strconv.FormatInt(objnum%kg.threads, 10),
+			"{seq}", seq,
+			"{rand}", keyRand(objnum))
+		return kg.prefix + r.Replace(kg.template)
+	}
+	return kg.prefix + seq
+}
+
+// matches -- whether key looks like something hsbench created with this layout
+func (kg *KeyGen) matches(key string) bool {
+	return kg.re.MatchString(key)
+}
@@ -0,0 +1,69 @@
+// keys_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDirName(t *testing.T) {
+	for i, want := range map[int64]string{0: "a", 25: "z", 26: "ba", 27: "bb", 676: "baa"} {
+		if got := dirName(i); got != want {
+			t.Errorf("dirName(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestKeyLayouts(t *testing.T) {
+	flat := makeKeyGen("flat", "obj_", 0, 0, 0, 0, "", "", 1)
+	tree := makeKeyGen("tree", "", 3, 2, 2, 0, "", "", 1)
+	hash := makeKeyGen("hash", "", 0, 0, 0, 4, "", "", 1)
+	tmpl := makeKeyGen("template", "x/", 0, 0, 0, 0, "{client}/t{thread}/{rand}-{seq}", "c1", 4)
+	tests := []struct {
+		kg     KeyGen
+		objnum int64
+		want   string
+	}{
+		{flat, 7, "obj_000000000007"},
+		{tree, 0, "a/a/a/000000000000"},
+		{tree, 5, "a/b/a/000000000005"},
+		{tree, 13, "b/b/a/000000000013"},
+		{hash, 7, "397a/000000000007"},
+		{tmpl, 7, "x/c1/t3/320ca3f6-000000000007"},
+		{tmpl, 42, "x/c1/t2/87e38583-000000000042"},
+	}
+	for _, tt := range tests {
+		if got := tt.kg.key(tt.objnum); got != tt.want {
+			t.Errorf("%s key(%d) = %s, want %s", tt.kg.layout, tt.objnum, got, tt.want)
+		}
+	}
+}
+
+func TestKeyMatches(t *testing.T) {
+	gens := []KeyGen{
+		makeKeyGen("flat", "obj_", 0, 0, 0, 0, "", "", 1),
+		makeKeyGen("tree", "obj_", 3, 2, 2, 0, "", "", 1),
+		makeKeyGen("hash", "obj_", 0, 0, 0, 4, "", "", 1),
+		makeKeyGen("template", "obj_", 0, 0, 0, 0, "{client}.{thread}.{rand}.{seq}", "c1", 4),
+	}
+	for i, kg := range gens {
+		for _, objnum := range []int64{0, 5, 123456} {
+			key := kg.key(objnum)
+			if !kg.matches(key) || !kg.matches(key+".copy") {
+				t.Errorf("%s doesn't match its own key %s", kg.layout, key)
+			}
+			if kg.matches("other_"+key) || kg.matches(key+".tmp") {
+				t.Errorf("%s matches keys around %s", kg.layout, key)
+			}
+			other := gens[(i+1)%len(gens)]
+			if kg.matches(other.key(objnum)) {
+				t.Errorf("%s matches the %s key %s", kg.layout, other.layout, other.key(objnum))
+			}
+		}
+	}
+	flat := gens[0]
+	if flat.matches("obj_0000000007") {
+		t.Errorf("flat matches a short sequence number")
+	}
+}
@@ -0,0 +1,187 @@
+// metrics.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Address to serve Prometheus metrics on during the run, empty for none
+var metrics_listen string
+
+// Upper bounds in seconds of the buckets of the latency histograms
+var metricBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Classes failed requests are counted in
+var errorClasses = []string{"timeout", "throttled", "client", "server", "other"}
+
+// metricKey -- the labels of a series besides the endpoint, which all of
+// them share
+type metricKey struct {
+	mode, op, bucket string
+}
+
+// metricSeries -- the counters of one series, updated atomically by every
+// thread
+type metricSeries struct {
+	ops, bytes, latNano int64
+	buckets             []int64
+	errors              []int64
+}
+
+// All series by metricKey, and the requests being sent
+var metric_series sync.Map
+var metric_inflight int64
+
+func metricsFor(key metricKey) *metricSeries {
+	if ms, ok := metric_series.Load(key); ok {
+		return ms.(*metricSeries)
+	}
+	ms, _ := metric_series.LoadOrStore(key, &metricSeries{
+		buckets: make([]int64, len(metricBuckets)),
+		errors:  make([]int64, len(errorClasses)),
+	})
+	return ms.(*metricSeries)
+}
+
+// metricOp -- count an op like Stats.addOp does
+func metricOp(key metricKey, bytes int64, latNano int64) {
+	if metrics_listen == "" {
+		return
+	}
+	ms := metricsFor(key)
+	atomic.AddInt64(&ms.ops, 1)
+	atomic.AddInt64(&ms.bytes, bytes)
+	atomic.AddInt64(&ms.latNano, latNano)
+	secs := float64(latNano) / 1e9
+	if i := sort.SearchFloat64s(metricBuckets, secs); i < len(metricBuckets) {
+		atomic.AddInt64(&ms.buckets[i], 1)
+	}
+}
+
+// metricError -- count a failed request like Stats.addSlowDown does, in
+// the class of err.  ctx is the context the request was sent with.
+func metricError(key metricKey, ctx context.Context, err error) {
+	if metrics_listen == "" {
+		return
+	}
+	ms := metricsFor(key)
+	atomic.AddInt64(&ms.errors[errorClass(ctx, err)], 1)
+}
+
+// errorClass -- the index in errorClasses of a failed request
+func errorClass(ctx context.Context, err error) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		return 0
+	}
+	if reqerr, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case reqerr.StatusCode() == http.StatusServiceUnavailable || reqerr.Code() == "SlowDown":
+			return 1
+		case reqerr.StatusCode() >= 400 && reqerr.StatusCode() < 500:
+			return 2
+		case reqerr.StatusCode() >= 500:
+			return 3
+		}
+	}
+	return 4
+}
+
+// metricBusy -- add delta to the requests being sent
+func metricBusy(delta int64) {
+	if metrics_listen != "" {
+		atomic.AddInt64(&metric_inflight, delta)
+	}
+}
+
+// labelValue -- quote v for the exposition format
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+// writeMetrics -- serve every series in the Prometheus text format
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	keys := make([]metricKey, 0)
+	metric_series.Range(func(k, v interface{}) bool {
+		keys = append(keys, k.(metricKey))
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.mode != b.mode {
+			return a.mode < b.mode
+		}
+		if a.op != b.op {
+			return a.op < b.op
+		}
+		return a.bucket < b.bucket
+	})
+	endpoint := "endpoint=" + labelValue(url_host)
+	labels := make([]string, len(keys))
+	series := make([]*metricSeries, len(keys))
+	for i, k := range keys {
+		labels[i] = fmt.Sprintf("%s,mode=%s,op=%s,bucket=%s", endpoint, labelValue(k.mode), labelValue(k.op), labelValue(k.bucket))
+		series[i] = metricsFor(k)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	header := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("hsbench_ops_total", "counter", "Number of ops that succeeded.")
+	for i, ms := range series {
+		fmt.Fprintf(w, "hsbench_ops_total{%s} %d\n", labels[i], atomic.LoadInt64(&ms.ops))
+	}
+	header("hsbench_bytes_total", "counter", "Number of bytes moved by the ops that succeeded.")
+	for i, ms := range series {
+		fmt.Fprintf(w, "hsbench_bytes_total{%s} %d\n", labels[i], atomic.LoadInt64(&ms.bytes))
+	}
+	header("hsbench_errors_total", "counter", "Number of failed requests, retries included, by class.")
+	for i, ms := range series {
+		for c, class := range errorClasses {
+			fmt.Fprintf(w, "hsbench_errors_total{%s,class=%s} %d\n", labels[i], labelValue(class), atomic.LoadInt64(&ms.errors[c]))
+		}
+	}
+	header("hsbench_op_latency_seconds", "histogram", "Latency of the ops that succeeded.")
+	for i, ms := range series {
+		ops := atomic.LoadInt64(&ms.ops)
+		count := int64(0)
+		for b, le := range metricBuckets {
+			count += atomic.LoadInt64(&ms.buckets[b])
+			if count > ops {
+				count = ops
+			}
+			fmt.Fprintf(w, "hsbench_op_latency_seconds_bucket{%s,le=\"%s\"} %d\n", labels[i], strconv.FormatFloat(le, 'g', -1, 64), count)
+		}
+		fmt.Fprintf(w, "hsbench_op_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels[i], ops)
+		fmt.Fprintf(w, "hsbench_op_latency_seconds_sum{%s} %g\n", labels[i], float64(atomic.LoadInt64(&ms.latNano))/1e9)
+		fmt.Fprintf(w, "hsbench_op_latency_seconds_count{%s} %d\n", labels[i], ops)
+	}
+	header("hsbench_inflight_requests", "gauge", "Number of requests being sent.")
+	fmt.Fprintf(w, "hsbench_inflight_requests{%s} %d\n", endpoint, atomic.LoadInt64(&metric_inflight))
+	header("hsbench_running_threads", "gauge", "Number of threads running the current stage.")
+	fmt.Fprintf(w, "hsbench_running_threads{%s} %d\n", endpoint, atomic.LoadInt64(&running_threads))
+}
+
+// serveMetrics -- serve /metrics on -metrics-listen for the rest of the run
+func serveMetrics() {
+	l, err := net.Listen("tcp", metrics_listen)
+	if err != nil {
+		log.Fatalf("Could not listen on %s for metrics: %v", metrics_listen, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	go http.Serve(l, mux)
+	log.Printf("Serving metrics on http://%s/metrics", l.Addr())
+}
@@ -0,0 +1,13 @@
+// odirect_linux.go
+// Copyright (c) 2019 Red Hat Inc.
+
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// oDirect -- the open flag that bypasses the page cache
+const oDirect = syscall.O_DIRECT
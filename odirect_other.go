@@ -0,0 +1,9 @@
+// odirect_other.go
+// Copyright (c) 2019 Red Hat Inc.
+
+//go:build !linux
+
+package main
+
+// oDirect -- O_DIRECT is Linux only, -odirect is refused everywhere else
+const oDirect = 0
@@ -0,0 +1,119 @@
+// output.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Append to the -o and -j files instead of truncating them
+var output_append bool
+
+// Seconds between flushes of the -o file
+const resultsFlush = time.Second
+
+// The -o and -j files, written to as the results come in from all threads
+var results struct {
+	mu       sync.Mutex
+	csvFile  *os.File
+	csv      *csv.Writer
+	jsonFile *os.File
+}
+
+// openResult -- open -o or -j, truncated unless -append was given, and
+// tell whether it is empty
+func openResult(name string, what string) (*os.File, bool) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if output_append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		log.Fatalf("Could not open %s file %s for writing: %v", what, name, err)
+	}
+	info, err := file.Stat()
+	return file, err == nil && info.Size() == 0
+}
+
+// openResults -- open the -o and -j files, if any.  A CSV file gets a
+// header unless rows are appended to an earlier one, and the run is
+// described on the first of its lines in the JSON file.
+func openResults() {
+	if output != "" {
+		var empty bool
+		results.csvFile, empty = openResult(output, "CSV")
+		results.csv = csv.NewWriter(results.csvFile)
+		if empty {
+			(&OutputStats{}).csv_header(results.csv)
+		}
+		go flushResultsEvery(resultsFlush)
+	}
+	if json_output != "" {
+		results.jsonFile, _ = openResult(json_output, "JSON")
+		writeRecord(results.jsonFile, &run_info)
+	}
+}
+
+// writeResult -- add a row to the -o file, which is flushed every second,
+// and a line to the -j file
+func writeResult(o *OutputStats) {
+	results.mu.Lock()
+	defer results.mu.Unlock()
+	if results.csv != nil {
+		o.csv(results.csv)
+	}
+	if results.jsonFile != nil {
+		o.json(results.jsonFile)
+	}
+}
+
+// flushResults -- write out the buffered rows of the -o file, with
+// results.mu held
+func flushResults() {
+	if results.csv == nil {
+		return
+	}
+	results.csv.Flush()
+	if err := results.csv.Error(); err != nil {
+		log.Fatal("Error writing to CSV file: ", err)
+	}
+}
+
+// flushResultsEvery -- flush the -o file every period until it is closed,
+// so that the rows of a long interval don't sit in the buffer
+func flushResultsEvery(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		results.mu.Lock()
+		if results.csv == nil {
+			results.mu.Unlock()
+			return
+		}
+		flushResults()
+		results.mu.Unlock()
+	}
+}
+
+// closeResults -- flush and close the -o and -j files, ending the run in
+// the JSON file with status completed or interrupted
+func closeResults(status string) {
+	results.mu.Lock()
+	defer results.mu.Unlock()
+	flushResults()
+	if results.csvFile != nil {
+		results.csvFile.Close()
+		results.csvFile = nil
+		results.csv = nil
+	}
+	if results.jsonFile != nil {
+		writeRecord(results.jsonFile, &RunEnd{endSchema, run_info.RunID, time.Now(), status})
+		results.jsonFile.Close()
+		results.jsonFile = nil
+	}
+}
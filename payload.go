@@ -0,0 +1,251 @@
+// payload.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload signing (-ps) and checksum (-ck, -ckt) settings for PUT requests
+var payload_signing, payload_checksum string
+var payload_trailer bool
+
+// Size of the chunks used for aws-chunked uploads
+const payloadChunkSize = 64 * 1024
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumHeader -- the header carrying the checksum for an algorithm
+func checksumHeader(alg string) string {
+	if alg == "md5" {
+		return "Content-MD5"
+	}
+	return "x-amz-checksum-" + alg
+}
+
+// checksumValue -- the base64 encoded checksum of data.  This is computed
+// for every request on purpose, the cost is part of what is measured.
+func checksumValue(alg string, data []byte) string {
+	var h hash.Hash
+	switch alg {
+	case "md5":
+		h = md5.New()
+	case "crc32":
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, crc32.ChecksumIEEE(data))
+		return base64.StdEncoding.EncodeToString(b)
+	case "crc32c":
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, crc32.Checksum(data, crc32cTable))
+		return base64.StdEncoding.EncodeToString(b)
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	}
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// sizedReader -- stands in for a body of a given size so that the SDK sets
+// and signs the right Content-Length for aws-chunked uploads.  The real
+// body is swapped in after signing, since the chunk signatures depend on
+// the request signature.
+type sizedReader struct {
+	size   int64
+	offset int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if n > r.size-r.offset {
+		n = r.size - r.offset
+	}
+	r.offset += n
+	return int(n), nil
+}
+
+func (r *sizedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.offset = offset
+	case io.SeekCurrent:
+		r.offset += offset
+	case io.SeekEnd:
+		r.offset = r.size + offset
+	}
+	return r.offset, nil
+}
+
+// chunkedLength -- the encoded size of an aws-chunked body
+func chunkedLength(size int64, signed bool, trailer string) int64 {
+	// Every chunk is <hex size>[;chunk-signature=<64 hex>]\r\n<data>\r\n
+	chunk := func(n int64) int64 {
+		l := int64(len(strconv.FormatInt(n, 16))) + 2 + n + 2
+		if signed {
+			l += int64(len(";chunk-signature=")) + 64
+		}
+		return l
+	}
+	length := int64(0)
+	for off := int64(0); off < size; off += payloadChunkSize {
+		n := size - off
+		if n > payloadChunkSize {
+			n = payloadChunkSize
+		}
+		length += chunk(n)
+	}
+	// The final chunk is empty and without a trailer ends in \r\n\r\n
+	length += chunk(0)
+	if trailer != "" {
+		// The trailer replaces the final \r\n of the last chunk
+		length += int64(len(trailer)) + 2
+		if signed {
+			length += int64(len("x-amz-trailer-signature:")) + 64 + 2
+		}
+	}
+	return length
+}
+
+// v4SigningKey -- derive the SigV4 key for a date and region
+func v4SigningKey(date string, region string) []byte {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	return mac(mac(mac(mac([]byte("AWS4"+secret_key), date), region), "s3"), "aws4_request")
+}
+
+// encodeChunked -- encode data as an aws-chunked body.  When signed, seed is
+// the signature of the request and every chunk is chained to the previous
+// signature as described for STREAMING-AWS4-HMAC-SHA256-PAYLOAD.
+func encodeChunked(data []byte, signed bool, trailer string, amzDate string, seed string) []byte {
+	var key []byte
+	var scope string
+	prev := seed
+	if signed {
+		key = v4SigningKey(amzDate[:8], region)
+		scope = amzDate[:8] + "/" + region + "/s3/aws4_request"
+	}
+	sign := func(kind string, digest string) string {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(kind + "\n" + amzDate + "\n" + scope + "\n" + prev + "\n" + digest))
+		prev = hex.EncodeToString(h.Sum(nil))
+		return prev
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(chunkedLength(int64(len(data)), signed, trailer)))
+	writeChunk := func(chunk []byte) {
+		buf.WriteString(strconv.FormatInt(int64(len(chunk)), 16))
+		if signed {
+			sum := sha256.Sum256(chunk)
+			buf.WriteString(";chunk-signature=")
+			buf.WriteString(sign("AWS4-HMAC-SHA256-PAYLOAD", emptySHA256+"\n"+hex.EncodeToString(sum[:])))
+		}
+		buf.WriteString("\r\n")
+		buf.Write(chunk)
+		if len(chunk) > 0 || trailer == "" {
+			buf.WriteString("\r\n")
+		}
+	}
+	for off := 0; off < len(data); off += payloadChunkSize {
+		end := off + payloadChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		writeChunk(data[off:end])
+	}
+	writeChunk(nil)
+	if trailer != "" {
+		buf.WriteString(trailer + "\r\n")
+		if signed {
+			sum := sha256.Sum256([]byte(trailer + "\n"))
+			buf.WriteString("x-amz-trailer-signature:")
+			buf.WriteString(sign("AWS4-HMAC-SHA256-TRAILER", hex.EncodeToString(sum[:])))
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// setPayload -- configure how a PUT request carries and protects data.  It
+// has to be called before the request is sent.
+func setPayload(req *request.Request, in *s3.PutObjectInput, data []byte) {
+	hdr := req.HTTPRequest.Header
+	streaming := payload_signing == "streaming" || payload_trailer
+
+	// Checksums sent as headers are part of the signed request
+	if payload_checksum != "none" && !payload_trailer {
+		hdr.Set(checksumHeader(payload_checksum), checksumValue(payload_checksum, data))
+	}
+	if !streaming {
+		if payload_signing == "unsigned" {
+			// Disable payload checksum calculation (very expensive)
+			hdr.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		}
+		// Otherwise the signer hashes the whole body itself
+		return
+	}
+
+	signed := payload_signing != "unsigned"
+	trailer := ""
+	if payload_trailer {
+		hdr.Set("X-Amz-Trailer", checksumHeader(payload_checksum))
+		// Computed up front so it's counted, but sent after the data
+		trailer = checksumHeader(payload_checksum) + ":" + checksumValue(payload_checksum, data)
+	}
+	switch {
+	case signed && payload_trailer:
+		hdr.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER")
+	case signed:
+		hdr.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	default:
+		hdr.Set("X-Amz-Content-Sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+	}
+	hdr.Set("Content-Encoding", "aws-chunked")
+	hdr.Set("X-Amz-Decoded-Content-Length", strconv.Itoa(len(data)))
+	in.Body = &sizedReader{size: chunkedLength(int64(len(data)), signed, trailer)}
+
+	// Runs on every attempt, after the request has been (re)signed
+	req.Handlers.Send.PushFront(func(r *request.Request) {
+		seed := ""
+		if signed {
+			auth := r.HTTPRequest.Header.Get("Authorization")
+			if i := strings.LastIndex(auth, "Signature="); i >= 0 {
+				seed = auth[i+len("Signature="):]
+			}
+		}
+		amzDate := r.HTTPRequest.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = time.Now().UTC().Format("20060102T150405Z")
+		}
+		body := encodeChunked(data, signed, trailer, amzDate, seed)
+		r.HTTPRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.HTTPRequest.ContentLength = int64(len(body))
+	})
+}
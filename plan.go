@@ -0,0 +1,665 @@
+// plan.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"code.cloudfoundry.org/bytefmt"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Stage -- one step of a run.  It runs a single mode, or a weighted mix of
+// object modes at the same time, with its own threads, object sizes, keys
+// and limits.  Unset fields take their value from the defaults.
+type Stage struct {
+	Name string `yaml:"name"`
+	// One of the -m modes, or the weights of the modes to mix
+	Op  string             `yaml:"op"`
+	Mix map[string]float64 `yaml:"mix"`
+	// Number of threads, like -t
+	Threads int `yaml:"threads"`
+	// Object sizes, see parseSizeDist
+	Size string `yaml:"size"`
+	// Range of object numbers addressed, "first-last"
+	Keys string `yaml:"keys"`
+	// Seconds to run, like -d
+	Duration int `yaml:"duration"`
+	// Number of ops to run instead of -n, -1 for unlimited
+	Count int64 `yaml:"count"`
+	// Ops per second across all threads, -1 for unlimited
+	Rate float64 `yaml:"rate"`
+	// Number of times the stage is run in a row
+	Repeat int `yaml:"repeat"`
+	// Seconds to run before ops are counted and to start the threads
+	// over, like -warmup and -rampup, -1 for none
+	Warmup float64 `yaml:"warmup"`
+	Rampup float64 `yaml:"rampup"`
+
+	// The fields given a 0 on purpose, which isn't left for inherit to
+	// fill in, by their yaml name
+	zeros map[string]bool
+
+	// Filled in by check
+	modes    []rune
+	weights  []float64
+	total    float64
+	sizes    sizeDist
+	firstKey int64
+	keyCount int64
+}
+
+// The stages run by every loop, in order
+var plan []*Stage
+
+// Workload file given with -w
+var workload string
+
+// UnmarshalYAML -- decode a stage, noting the fields set to 0 in it
+func (st *Stage) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Stage
+	if err := unmarshal((*plain)(st)); err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	for _, name := range []string{"duration", "warmup", "rampup"} {
+		if v, ok := fields[name]; ok && v != nil {
+			st.setZero(name, v == 0 || v == 0.0)
+		}
+	}
+	return nil
+}
+
+// setZero -- record whether the field with the yaml name name was given a 0
+func (st *Stage) setZero(name string, zero bool) {
+	if st.zeros == nil {
+		st.zeros = map[string]bool{}
+	}
+	st.zeros[name] = zero
+}
+
+// inherit -- fill in the fields of the stage that were left unset from d
+func (st *Stage) inherit(d *Stage) {
+	if st.Threads == 0 {
+		st.Threads = d.Threads
+	}
+	if st.Size == "" {
+		st.Size = d.Size
+	}
+	if st.Keys == "" {
+		st.Keys = d.Keys
+	}
+	if st.Duration == 0 && !st.zeros["duration"] {
+		st.Duration = d.Duration
+	}
+	if st.Count == 0 {
+		st.Count = d.Count
+	}
+	if st.Rate == 0 {
+		st.Rate = d.Rate
+	}
+	if st.Repeat == 0 {
+		st.Repeat = d.Repeat
+	}
+	if st.Warmup == 0 && !st.zeros["warmup"] {
+		st.Warmup = d.Warmup
+	}
+	if st.Rampup == 0 && !st.zeros["rampup"] {
+		st.Rampup = d.Rampup
+	}
+}
+
+// check -- validate the stage and parse its fields
+func (st *Stage) check() error {
+	st.modes = nil
+	st.weights = nil
+	switch {
+	case st.Op != "" && len(st.Mix) > 0:
+		return fmt.Errorf("has both an op and a mix")
+	case st.Op != "":
+		r := []rune(st.Op)
+		if _, ok := modeSpecs[r[0]]; !ok || len(r) != 1 {
+			return fmt.Errorf("has an invalid op '%s'", st.Op)
+		}
+		st.modes = r
+		st.weights = []float64{1}
+	case len(st.Mix) > 0:
+		// Sort the modes so that the stats come out in the same order
+		ops := make([]string, 0, len(st.Mix))
+		for op := range st.Mix {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			r := []rune(op)
+			if len(r) != 1 || !strings.ContainsRune("pghyvrkd", r[0]) {
+				return fmt.Errorf("mixes '%s', only the p, g, h, y, v, r, k and d modes can be mixed", op)
+			}
+			if st.Mix[op] <= 0 {
+				return fmt.Errorf("has a mix weight for '%s' that isn't positive", op)
+			}
+			st.modes = append(st.modes, r[0])
+			st.weights = append(st.weights, st.Mix[op])
+		}
+	default:
+		return fmt.Errorf("needs an op or a mix")
+	}
+	st.total = 0
+	for _, w := range st.weights {
+		st.total += w
+	}
+	if st.Threads < 1 {
+		return fmt.Errorf("needs at least 1 thread")
+	}
+	var err error
+	if st.sizes, err = parseSizeDist(st.Size); err != nil {
+		return fmt.Errorf("has an invalid size: %v", err)
+	}
+	st.firstKey = 0
+	st.keyCount = 0
+	if st.Keys != "" {
+		if modeSpecs[st.modes[0]].bucket || st.modes[0] == 'b' {
+			return fmt.Errorf("has keys, but only object modes address single keys")
+		}
+		var last int64
+		parts := strings.SplitN(st.Keys, "-", 2)
+		if len(parts) == 2 {
+			st.firstKey, err = strconv.ParseInt(parts[0], 10, 64)
+			if err == nil {
+				last, err = strconv.ParseInt(parts[1], 10, 64)
+			}
+		}
+		if len(parts) != 2 || err != nil || st.firstKey < 0 || last < st.firstKey {
+			return fmt.Errorf("has invalid keys '%s', must be first-last", st.Keys)
+		}
+		st.keyCount = last - st.firstKey + 1
+	}
+	if st.Repeat < 1 {
+		return fmt.Errorf("needs a repeat count of at least 1")
+	}
+	return nil
+}
+
+// bounded -- whether the stage ends without a duration.  Bucket modes run
+// to completion, and object modes without a count of their own stop at -n,
+// or at the objects written by an earlier stage when written is set.
+func (st *Stage) bounded(written bool) bool {
+	if modeSpecs[st.modes[0]].bucket || st.Count > 0 {
+		return true
+	}
+	return st.Count == 0 && written
+}
+
+// objnum -- the object addressed by op number n
+func (st *Stage) objnum(n int64) int64 {
+	if st.keyCount > 0 {
+		return st.firstKey + n%st.keyCount
+	}
+	return n
+}
+
+// planModes -- the modes of every stage of the plan, in order
+func planModes() string {
+	modes := ""
+	for _, st := range plan {
+		modes += string(st.modes)
+	}
+	return modes
+}
+
+// pick -- choose the mode of the next op by the weights of the mix, by
+// index into modes
+func (st *Stage) pick(rnd *rand.Rand) int {
+	if len(st.modes) == 1 {
+		return 0
+	}
+	w := rnd.Float64() * st.total
+	for i := range st.weights {
+		if w < st.weights[i] {
+			return i
+		}
+		w -= st.weights[i]
+	}
+	return len(st.weights) - 1
+}
+
+// has -- whether the stage runs mode r
+func (st *Stage) has(r rune) bool {
+	for _, m := range st.modes {
+		if m == r {
+			return true
+		}
+	}
+	return false
+}
+
+// desc -- describe what the stage runs for the logs
+func (st *Stage) desc() string {
+	if len(st.modes) == 1 {
+		return modeSpecs[st.modes[0]].desc
+	}
+	parts := make([]string, len(st.modes))
+	for i, r := range st.modes {
+		parts[i] = fmt.Sprintf("%s %.0f%%", modeSpecs[r].desc, 100*st.weights[i]/st.total)
+	}
+	return "MIXED " + strings.Join(parts, ", ")
+}
+
+func (st *Stage) String() string {
+	ops := string(st.modes)
+	if len(st.Mix) > 0 {
+		parts := make([]string, len(st.modes))
+		for i, r := range st.modes {
+			parts[i] = fmt.Sprintf("%c:%g", r, st.weights[i])
+		}
+		ops = strings.Join(parts, ",")
+	}
+	s := fmt.Sprintf("%s threads=%d size=%s duration=%d", ops, st.Threads, st.sizes, st.Duration)
+	if st.Count != 0 {
+		s += fmt.Sprintf(" count=%d", st.Count)
+	}
+	if st.Keys != "" {
+		s += " keys=" + st.Keys
+	}
+	if st.Rate > 0 {
+		s += fmt.Sprintf(" rate=%g", st.Rate)
+	}
+	if st.Repeat > 1 {
+		s += fmt.Sprintf(" repeat=%d", st.Repeat)
+	}
+	if st.Warmup > 0 {
+		s += fmt.Sprintf(" warmup=%g", st.Warmup)
+	}
+	if st.Rampup > 0 {
+		s += fmt.Sprintf(" rampup=%g", st.Rampup)
+	}
+	if st.Name != "" {
+		s = st.Name + ": " + s
+	}
+	return s
+}
+
+// sizeRange -- sizes from min to max, picked with the given weight
+type sizeRange struct {
+	min    int64
+	max    int64
+	weight float64
+}
+
+// sizeDist -- the object sizes of a stage.  The size of an object is
+// derived from its number, so every stage with the same distribution
+// agrees on it.
+type sizeDist struct {
+	ranges []sizeRange
+	total  float64
+	// Sizes picked from ranges are rounded down to a multiple of this
+	align int64
+}
+
+// parseSizeDist -- parse a comma separated list of sizes or min-max ranges,
+// each optionally followed by :weight, i.e. "4K", "4K-1M" or "4K:90,1M:10"
+func parseSizeDist(s string) (sizeDist, error) {
+	d := sizeDist{align: 1}
+	if file_odirect {
+		d.align = directAlign
+	}
+	for _, part := range strings.Split(s, ",") {
+		r := sizeRange{weight: 1}
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			w, err := strconv.ParseFloat(part[i+1:], 64)
+			if err != nil || w <= 0 {
+				return d, fmt.Errorf("invalid weight in %s", part)
+			}
+			r.weight = w
+			part = part[:i]
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		for i, b := range bounds {
+			size, err := bytefmt.ToBytes(b)
+			if err != nil {
+				return d, err
+			}
+			if i == 0 {
+				r.min = int64(size)
+			}
+			r.max = int64(size)
+		}
+		if r.max < r.min {
+			return d, fmt.Errorf("%s is not a valid range", part)
+		}
+		if r.min%d.align != 0 || r.max%d.align != 0 {
+			return d, fmt.Errorf("%s is not a multiple of %d bytes", part, d.align)
+		}
+		d.ranges = append(d.ranges, r)
+		d.total += r.weight
+	}
+	return d, nil
+}
+
+// mix64 -- the splitmix64 finalizer, to spread object numbers evenly
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// size -- the size of object objnum
+func (d *sizeDist) size(objnum int64) int64 {
+	r := d.ranges[0]
+	h := mix64(uint64(objnum))
+	if len(d.ranges) > 1 {
+		pick := float64(h>>11) / (1 << 53) * d.total
+		for _, r = range d.ranges {
+			if pick < r.weight {
+				break
+			}
+			pick -= r.weight
+		}
+		h = mix64(h)
+	}
+	if r.min == r.max {
+		return r.min
+	}
+	size := r.min + int64(h%uint64(r.max-r.min+1))
+	return size - size%d.align
+}
+
+// max -- the largest size the distribution can produce
+func (d *sizeDist) max() int64 {
+	max := int64(0)
+	for _, r := range d.ranges {
+		if r.max > max {
+			max = r.max
+		}
+	}
+	return max
+}
+
+func (d sizeDist) String() string {
+	parts := make([]string, len(d.ranges))
+	for i, r := range d.ranges {
+		parts[i] = bytefmt.ByteSize(uint64(r.min))
+		if r.max != r.min {
+			parts[i] += "-" + bytefmt.ByteSize(uint64(r.max))
+		}
+		if len(d.ranges) > 1 {
+			parts[i] += ":" + strconv.FormatFloat(r.weight, 'g', -1, 64)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseModes -- turn the -m mode string into stages.  Every mode can be
+// followed by [name=value,...] to override the defaults for its stage, and
+// the modes can be separated by commas.
+func parseModes(s string) ([]*Stage, error) {
+	var stages []*Stage
+	r := []rune(s)
+	for i := 0; i < len(r); i++ {
+		if r[i] == ',' {
+			continue
+		}
+		if _, ok := modeSpecs[r[i]]; !ok {
+			return nil, fmt.Errorf("invalid mode '%c'", r[i])
+		}
+		st := &Stage{Op: string(r[i])}
+		if i+1 < len(r) && r[i+1] == '[' {
+			end := i + 2
+			for end < len(r) && r[end] != ']' {
+				end++
+			}
+			if end == len(r) {
+				return nil, fmt.Errorf("missing ] after %c[", r[i])
+			}
+			if err := st.override(string(r[i+2 : end])); err != nil {
+				return nil, fmt.Errorf("%c[%s]: %v", r[i], string(r[i+2:end]), err)
+			}
+			i = end
+		}
+		stages = append(stages, st)
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no modes")
+	}
+	return stages, nil
+}
+
+// override -- set the stage fields named in a comma separated list of
+// name=value pairs.  The names are those of the workload file fields, or
+// the flags they default to.  Only the duration, warmup and rampup can be
+// set to 0.
+func (st *Stage) override(params string) error {
+	var names, values []string
+	for _, part := range strings.Split(params, ",") {
+		if i := strings.Index(part, "="); i >= 0 {
+			names = append(names, part[:i])
+			values = append(values, part[i+1:])
+		} else if len(values) > 0 {
+			// Size distributions have commas of their own
+			values[len(values)-1] += "," + part
+		} else {
+			return fmt.Errorf("%s is not a name=value pair", part)
+		}
+	}
+	for i, name := range names {
+		v := values[i]
+		var err error
+		zero := false
+		switch name {
+		case "t", "threads":
+			st.Threads, err = strconv.Atoi(v)
+			zero = st.Threads == 0
+		case "z", "size":
+			st.Size = v
+			zero = v == ""
+		case "d", "duration":
+			st.Duration, err = strconv.Atoi(v)
+			st.setZero("duration", st.Duration == 0)
+		case "n", "count":
+			st.Count, err = strconv.ParseInt(v, 10, 64)
+			zero = st.Count == 0
+		case "keys":
+			st.Keys = v
+			zero = v == ""
+		case "rate":
+			st.Rate, err = strconv.ParseFloat(v, 64)
+			zero = st.Rate == 0
+		case "repeat":
+			st.Repeat, err = strconv.Atoi(v)
+			zero = st.Repeat == 0
+		case "warmup":
+			st.Warmup, err = strconv.ParseFloat(v, 64)
+			st.setZero("warmup", st.Warmup == 0)
+		case "rampup":
+			st.Rampup, err = strconv.ParseFloat(v, 64)
+			st.setZero("rampup", st.Rampup == 0)
+		default:
+			return fmt.Errorf("unknown parameter %s", name)
+		}
+		if err != nil || zero {
+			return fmt.Errorf("invalid value '%s' for %s", v, name)
+		}
+	}
+	return nil
+}
+
+// Workload -- the contents of a -w workload file
+type Workload struct {
+	// Values for ${name} references, unless the environment has one
+	Vars     map[string]string `yaml:"vars"`
+	Defaults Stage             `yaml:"defaults"`
+	Stages   []*Stage          `yaml:"stages"`
+}
+
+var varRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// substitute -- replace the ${name} references in every string of a
+// parsed document.  A string that is nothing but a reference takes the
+// type of the value, so that "threads: ${threads}" is still a number.
+func substitute(v interface{}, vars map[string]string) (interface{}, error) {
+	var err error
+	switch t := v.(type) {
+	case string:
+		missing := ""
+		s := varRef.ReplaceAllStringFunc(t, func(ref string) string {
+			name := varRef.FindStringSubmatch(ref)[1]
+			if val, ok := os.LookupEnv(name); ok {
+				return val
+			}
+			if val, ok := vars[name]; ok {
+				return val
+			}
+			missing = name
+			return ref
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("${%s} is not set in vars or the environment", missing)
+		}
+		if s != t && varRef.FindString(t) == t {
+			var typed interface{}
+			if yaml.Unmarshal([]byte(s), &typed) == nil && typed != nil {
+				return typed, nil
+			}
+		}
+		return s, nil
+	case map[interface{}]interface{}:
+		for k, e := range t {
+			if t[k], err = substitute(e, vars); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			if t[k], err = substitute(e, vars); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			if t[i], err = substitute(e, vars); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// loadWorkload -- read a YAML or, for .json files, JSON workload file
+func loadWorkload(path string) (*Workload, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The vars have to be known before anything else can be read
+	var vars struct {
+		Vars map[string]string `yaml:"vars"`
+	}
+	if err = remarshal(doc, &vars, false); err != nil {
+		return nil, err
+	}
+	if doc, err = substitute(doc, vars.Vars); err != nil {
+		return nil, err
+	}
+	w := &Workload{}
+	if err = remarshal(doc, w, true); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// remarshal -- decode a parsed YAML or JSON document into v, rejecting
+// unknown fields when strict is set
+func remarshal(doc interface{}, v interface{}, strict bool) error {
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if strict {
+		return yaml.UnmarshalStrict(data, v)
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// makePlan -- build the stages to run, from the workload file when there is
+// one and from -m otherwise.  The flags are the defaults of every stage.
+func makePlan() []*Stage {
+	if _, err := parseSizeDist(sizeArg); err != nil {
+		log.Fatalf("Invalid -z argument for object size: %v", err)
+	}
+	defaults := &Stage{
+		Threads:  threads,
+		Size:     sizeArg,
+		Duration: duration_secs,
+		Rate:     -1,
+		Repeat:   1,
+		Warmup:   -1,
+		Rampup:   -1,
+	}
+	if warmup_secs > 0 {
+		defaults.Warmup = warmup_secs
+	}
+	if rampup_secs > 0 {
+		defaults.Rampup = rampup_secs
+	}
+	var stages []*Stage
+	if workload != "" {
+		w, err := loadWorkload(workload)
+		if err != nil {
+			log.Fatalf("Unable to read the workload file %s: %v", workload, err)
+		}
+		if len(w.Stages) == 0 {
+			log.Fatalf("The workload file %s has no stages", workload)
+		}
+		w.Defaults.inherit(defaults)
+		defaults = &w.Defaults
+		stages = w.Stages
+	} else {
+		var err error
+		if stages, err = parseModes(modes); err != nil {
+			log.Fatalf("Invalid mode string passed to -m: %v", err)
+		}
+	}
+	// A p or v stage sets -n to the objects it wrote for the stages after
+	// it, see runWrapper
+	written := object_count > -1
+	for i, st := range stages {
+		st.inherit(defaults)
+		if err := st.check(); err != nil {
+			log.Fatalf("Stage %d %s", i+1, err)
+		}
+		if st.Duration < 0 && !st.bounded(written) {
+			log.Fatalf("Stage %d can not have both an unlimited count and duration", i+1)
+		}
+		// Batch deletes walk the objects up to -n, with no end to them
+		// otherwise
+		if st.has('b') && !written {
+			log.Fatalf("Stage %d batch deletes need -n or an earlier p or v stage to know which objects to delete", i+1)
+		}
+		if st.has('p') || st.has('v') {
+			written = true
+		}
+	}
+	return stages
+}
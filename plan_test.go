@@ -0,0 +1,137 @@
+// plan_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSizeDist(t *testing.T) {
+	valid := map[string]string{
+		"4K":          "4K",
+		"4K-64K":      "4K-64K",
+		"4K:90,1M:10": "4K:90,1M:10",
+		"1K-2K:3,8K":  "1K-2K:3,8K:1",
+	}
+	for s, want := range valid {
+		d, err := parseSizeDist(s)
+		if err != nil {
+			t.Errorf("parseSizeDist(%s): %v", s, err)
+			continue
+		}
+		if d.String() != want {
+			t.Errorf("parseSizeDist(%s) = %s, want %s", s, d.String(), want)
+		}
+	}
+	for _, s := range []string{"", "4Q", "4K:0", "4K:-1", "4K:x", "64K-4K", "4K-"} {
+		if _, err := parseSizeDist(s); err == nil {
+			t.Errorf("parseSizeDist(%s) didn't fail", s)
+		}
+	}
+}
+
+func TestSizeDistSizes(t *testing.T) {
+	d, err := parseSizeDist("1K-2K:3,1M:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.max() != 1024*1024 {
+		t.Errorf("max() = %d, want 1M", d.max())
+	}
+	big := 0
+	for objnum := int64(0); objnum < 10000; objnum++ {
+		size := d.size(objnum)
+		if size != d.size(objnum) {
+			t.Fatalf("object %d has more than one size", objnum)
+		}
+		switch {
+		case size == 1024*1024:
+			big++
+		case size < 1024 || size > 2048:
+			t.Fatalf("object %d has a size of %d", objnum, size)
+		}
+	}
+	// A quarter of the objects should be 1M
+	if big < 2200 || big > 2800 {
+		t.Errorf("%d of 10000 objects are 1M, want about 2500", big)
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	stages, err := parseModes("ip[t=64,z=4K-8K:1,1M:2],g,d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := ""
+	for _, st := range stages {
+		ops += st.Op
+	}
+	if ops != "ipgd" {
+		t.Fatalf("parseModes gave the ops %s, want ipgd", ops)
+	}
+	p := stages[1]
+	if p.Threads != 64 || p.Size != "4K-8K:1,1M:2" {
+		t.Errorf("p has threads=%d and size=%s", p.Threads, p.Size)
+	}
+	if g := stages[2]; g.Threads != 0 || g.Size != "" {
+		t.Errorf("the override of p leaked into g")
+	}
+
+	stages, err = parseModes("p[threads=2,size=1K,d=5,n=10,keys=0-9,rate=100,repeat=3,warmup=1.5,rampup=2]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := stages[0]
+	if st.Threads != 2 || st.Size != "1K" || st.Duration != 5 || st.Count != 10 || st.Keys != "0-9" ||
+		st.Rate != 100 || st.Repeat != 3 || st.Warmup != 1.5 || st.Rampup != 2 {
+		t.Errorf("the overrides gave %+v", *st)
+	}
+
+	for _, s := range []string{"", ",", "q", "p[t=2", "p[t=x]", "p[t=0]", "p[bogus=1]", "p[t]"} {
+		if _, err := parseModes(s); err == nil {
+			t.Errorf("parseModes(%s) didn't fail", s)
+		}
+	}
+}
+
+// TestExplicitZeros -- a duration, warmup or rampup of 0 isn't replaced by
+// the defaults, in the modes and in workload files
+func TestExplicitZeros(t *testing.T) {
+	defaults := &Stage{Threads: 1, Duration: 60, Warmup: 5, Rampup: 2}
+	stages, err := parseModes("p[d=0,warmup=0,rampup=0]g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range stages {
+		st.inherit(defaults)
+	}
+	if p := stages[0]; p.Duration != 0 || p.Warmup != 0 || p.Rampup != 0 {
+		t.Errorf("p has duration=%d, warmup=%g and rampup=%g, want 0", p.Duration, p.Warmup, p.Rampup)
+	}
+	if g := stages[1]; g.Duration != 60 || g.Warmup != 5 || g.Rampup != 2 {
+		t.Errorf("g has duration=%d, warmup=%g and rampup=%g, want the defaults", g.Duration, g.Warmup, g.Rampup)
+	}
+
+	path := filepath.Join(t.TempDir(), "workload.yaml")
+	yaml := "defaults:\n  warmup: 0\nstages:\n  - op: p\n    duration: 0\n    rampup: 0.0\n  - op: g\n"
+	if err = os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := loadWorkload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Defaults.inherit(defaults)
+	for _, st := range w.Stages {
+		st.inherit(&w.Defaults)
+	}
+	if p := w.Stages[0]; p.Duration != 0 || p.Warmup != 0 || p.Rampup != 0 {
+		t.Errorf("p has duration=%d, warmup=%g and rampup=%g, want 0", p.Duration, p.Warmup, p.Rampup)
+	}
+	if g := w.Stages[1]; g.Duration != 60 || g.Warmup != 0 || g.Rampup != 2 {
+		t.Errorf("g has duration=%d, warmup=%g and rampup=%g, want 60, 0 and 2", g.Duration, g.Warmup, g.Rampup)
+	}
+}
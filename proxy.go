@@ -0,0 +1,238 @@
+// proxy.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// "hsbench proxy" sits between hsbench and an S3 endpoint and degrades the
+// requests passing through it, so the effect of a misbehaving gateway on
+// the client and on the reported latencies can be measured without
+// breaking a real cluster.  Every request is delayed by the latency plus a
+// random share of the jitter, then at most one fault is picked for it.
+
+const (
+	faultNone = iota
+	faultSlowDown
+	faultReset
+	faultTruncate
+	faultStall
+)
+
+var faultNames = []string{"none", "slowdown", "reset", "truncate", "stall"}
+
+type faultProxy struct {
+	proxy     *httputil.ReverseProxy
+	latency   time.Duration
+	jitter    time.Duration
+	stallTime time.Duration
+	// Chance of each fault, indexed like faultNames
+	rates []float64
+	// Requests seen and faults injected, indexed like faultNames
+	counts []int64
+}
+
+func makeFaultProxy(target *url.URL) *faultProxy {
+	p := &faultProxy{
+		rates:  make([]float64, len(faultNames)),
+		counts: make([]int64, len(faultNames)),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		// The Host header is passed on as is since it is covered by
+		// the request signature
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+		},
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: 1024,
+			IdleConnTimeout:     time.Minute,
+			TLSClientConfig:     HTTPTransport.(*http.Transport).TLSClientConfig,
+		},
+		FlushInterval: -1,
+	}
+	return p
+}
+
+// pick -- choose the fault for the next request
+func (p *faultProxy) pick() int {
+	roll := rand.Float64()
+	for f := faultSlowDown; f < len(p.rates); f++ {
+		if roll < p.rates[f] {
+			return f
+		}
+		roll -= p.rates[f]
+	}
+	return faultNone
+}
+
+func (p *faultProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	delay := p.latency
+	if p.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.jitter)))
+	}
+	time.Sleep(delay)
+
+	fault := p.pick()
+	atomic.AddInt64(&p.counts[fault], 1)
+	switch fault {
+	case faultSlowDown:
+		memError(w, r, http.StatusServiceUnavailable, "SlowDown")
+	case faultReset:
+		// The request never reaches the endpoint
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	case faultTruncate, faultStall:
+		p.proxy.ServeHTTP(&faultWriter{ResponseWriter: w, fault: fault, stall: p.stallTime}, r)
+	default:
+		p.proxy.ServeHTTP(w, r)
+	}
+}
+
+// faultWriter -- truncates or stalls a response halfway through its body.
+// Responses without a Content-Length are stalled before the headers and
+// never truncated.
+type faultWriter struct {
+	http.ResponseWriter
+	fault int
+	stall time.Duration
+	// Bytes to let through before the fault, -1 once it is done
+	limit   int64
+	written int64
+}
+
+func (w *faultWriter) WriteHeader(status int) {
+	w.limit = -1
+	if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && n > 0 {
+		w.limit = n / 2
+	} else if w.fault == faultStall {
+		time.Sleep(w.stall)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *faultWriter) Write(b []byte) (int, error) {
+	if w.limit < 0 || w.written+int64(len(b)) <= w.limit {
+		n, err := w.ResponseWriter.Write(b)
+		w.written += int64(n)
+		return n, err
+	}
+	first := w.limit - w.written
+	n, err := w.ResponseWriter.Write(b[:first])
+	w.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+	if w.fault == faultTruncate {
+		// Closes the connection without finishing the body
+		panic(http.ErrAbortHandler)
+	}
+	time.Sleep(w.stall)
+	w.limit = -1
+	m, err := w.ResponseWriter.Write(b[first:])
+	w.written += int64(m)
+	return n + m, err
+}
+
+func (w *faultWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// logCounts -- report the injected faults every 10 seconds while requests
+// come in
+func (p *faultProxy) logCounts() {
+	last := int64(0)
+	for range time.Tick(10 * time.Second) {
+		total := int64(0)
+		counts := make([]int64, len(p.counts))
+		for f := range p.counts {
+			counts[f] = atomic.LoadInt64(&p.counts[f])
+			total += counts[f]
+		}
+		if total == last {
+			continue
+		}
+		last = total
+		log.Printf("Requests: %d, SlowDowns: %d, Resets: %d, Truncated: %d, Stalled: %d",
+			total, counts[faultSlowDown], counts[faultReset], counts[faultTruncate], counts[faultStall])
+	}
+}
+
+// runProxy -- "hsbench proxy", run the fault injecting proxy
+func runProxy(args []string) {
+	myflag := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := myflag.String("listen", "127.0.0.1:9001", "Address to listen on")
+	targetArg := myflag.String("target", "", "URL of the S3 endpoint to forward requests to, or mem:// for the built-in server")
+	latency := myflag.Duration("latency", 0, "Latency added to every request")
+	jitter := myflag.Duration("jitter", 0, "Maximum random latency added on top of -latency")
+	slowdown := myflag.Float64("slowdown", 0, "Fraction of requests answered with 503 SlowDown (0.0 - 1.0)")
+	reset := myflag.Float64("reset", 0, "Fraction of requests answered by resetting the connection (0.0 - 1.0)")
+	truncate := myflag.Float64("truncate", 0, "Fraction of responses cut off halfway through the body (0.0 - 1.0)")
+	stall := myflag.Float64("stall", 0, "Fraction of responses held for -stall-time halfway through the body (0.0 - 1.0)")
+	stallTime := myflag.Duration("stall-time", 30*time.Second, "How long stalled responses are held")
+	myflag.Usage = func() {
+		fmt.Fprintf(myflag.Output(), "\nUSAGE: %s proxy -target URL [OPTIONS]\n\nOPTIONS:\n", os.Args[0])
+		myflag.PrintDefaults()
+	}
+	if err := myflag.Parse(args); err != nil {
+		os.Exit(1)
+	}
+
+	if *targetArg == "" {
+		log.Fatal("Missing argument -target for the endpoint to forward to.")
+	}
+	if *targetArg == "mem://" {
+		*targetArg = startMemServer(false)
+	}
+	target, err := url.Parse(*targetArg)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		log.Fatal("The -target argument must be an http:// or https:// URL, or mem://")
+	}
+	if *latency < 0 || *jitter < 0 || *stallTime < 0 {
+		log.Fatal("The -latency, -jitter and -stall-time arguments can not be negative")
+	}
+	p := makeFaultProxy(target)
+	p.latency = *latency
+	p.jitter = *jitter
+	p.stallTime = *stallTime
+	p.rates[faultSlowDown] = *slowdown
+	p.rates[faultReset] = *reset
+	p.rates[faultTruncate] = *truncate
+	p.rates[faultStall] = *stall
+	sum := 0.0
+	for f := faultSlowDown; f < len(p.rates); f++ {
+		if p.rates[f] < 0 || p.rates[f] > 1 {
+			log.Fatalf("The -%s fraction must be between 0.0 and 1.0", faultNames[f])
+		}
+		sum += p.rates[f]
+	}
+	if sum > 1 {
+		log.Fatal("The -slowdown, -reset, -truncate and -stall fractions can not add up to more than 1.0")
+	}
+
+	log.Printf("Proxying http://%s to %s, latency=%s jitter=%s slowdown=%g reset=%g truncate=%g stall=%g stall_time=%s",
+		*listen, target, p.latency, p.jitter, *slowdown, *reset, *truncate, *stall, p.stallTime)
+	go p.logCounts()
+	log.Fatal(http.ListenAndServe(*listen, p))
+}
@@ -0,0 +1,249 @@
+// raw.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The raw driver (-driver raw) skips aws-sdk-go and issues object requests
+// directly over httpClient, signed with setSignature (V2) or setSignatureV4.
+var driver, signature_version string
+
+// Buffers for draining GET responses
+var rawBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 64*1024)
+		return &b
+	},
+}
+
+// rawError -- a failed raw request.  It satisfies awserr.RequestFailure so
+// callers can handle it the same way as SDK errors.
+type rawError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *rawError) Error() string {
+	return fmt.Sprintf("%s: %s, status code: %d", e.code, e.msg, e.status)
+}
+func (e *rawError) Code() string      { return e.code }
+func (e *rawError) Message() string   { return e.msg }
+func (e *rawError) OrigErr() error    { return nil }
+func (e *rawError) StatusCode() int   { return e.status }
+func (e *rawError) RequestID() string { return "" }
+
+// rawCheck -- turn a non 2xx response into a rawError, draining the body
+func rawCheck(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	e := &rawError{status: resp.StatusCode, code: http.StatusText(resp.StatusCode)}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var doc struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &doc) == nil && doc.Code != "" {
+		e.code = doc.Code
+		e.msg = doc.Message
+	}
+	return e
+}
+
+// rawRequest -- build a request for an object, or one version of it
+func rawRequest(ctx context.Context, method string, bucket string, key string, versionId string, body io.Reader) (*http.Request, error) {
+	u := strings.TrimSuffix(url_host, "/") + (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+	if versionId != "" {
+		u += "?versionId=" + url.QueryEscape(versionId)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// rawSend -- sign and send a request, the caller has to close the body
+func rawSend(req *http.Request, payloadHash string) (*http.Response, error) {
+	if signature_version == "v2" {
+		setSignature(req)
+	} else {
+		setSignatureV4(req, payloadHash)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = rawCheck(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// rawSSEHeaders -- the raw equivalent of ssePut/sseGet
+func rawSSEHeaders(req *http.Request, write bool) {
+	switch sse_mode {
+	case "AES256", "aws:kms":
+		if write {
+			req.Header.Set("X-Amz-Server-Side-Encryption", sse_mode)
+			if sse_mode == "aws:kms" && sse_kms_key_id != "" {
+				req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", sse_kms_key_id)
+			}
+		}
+	case "SSE-C":
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", sseCustomerAlgorithm)
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", sse_c_key_b64)
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", sse_c_key_md5)
+	}
+}
+
+// rawDriver -- sends object requests itself and leaves everything else,
+// bucket requests, listings, copies and batch deletes, to aws-sdk-go
+type rawDriver struct {
+	*sdkDriver
+}
+
+func (d *rawDriver) PutObject(ctx context.Context, bucket string, key string, data []byte) (string, error) {
+	// A new reader every time, the transport can still hold on to the body
+	// of a request after Do returned
+	req, err := rawRequest(ctx, "PUT", bucket, key, "", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if payload_checksum != "none" {
+		req.Header.Set(checksumHeader(payload_checksum), checksumValue(payload_checksum, data))
+	}
+	rawSSEHeaders(req, true)
+	resp, err := rawSend(req, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return "", err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Header.Get("X-Amz-Version-Id"), nil
+}
+
+// GetObject -- like GetObjectRequest().Send() this returns once the
+// headers are in, the caller reads the body with drainBody
+func (d *rawDriver) GetObject(ctx context.Context, bucket string, key string, versionId string) (io.ReadCloser, error) {
+	req, err := rawRequest(ctx, "GET", bucket, key, versionId, nil)
+	if err != nil {
+		return nil, err
+	}
+	rawSSEHeaders(req, false)
+	resp, err := rawSend(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// drainBody -- read and discard a response body with a pooled buffer
+func drainBody(body io.ReadCloser) (int64, error) {
+	buf := rawBufPool.Get().(*[]byte)
+	n, err := io.CopyBuffer(ioutil.Discard, body, *buf)
+	rawBufPool.Put(buf)
+	body.Close()
+	return n, err
+}
+
+func (d *rawDriver) HeadObject(ctx context.Context, bucket string, key string) (int64, error) {
+	req, err := rawRequest(ctx, "HEAD", bucket, key, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	rawSSEHeaders(req, false)
+	resp, err := rawSend(req, emptySHA256)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (d *rawDriver) DeleteObject(ctx context.Context, bucket string, key string, versionId string) error {
+	req, err := rawRequest(ctx, "DELETE", bucket, key, versionId, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rawSend(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// v4Escape -- URI encode a query string component the way SigV4 wants it
+func v4Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// setSignatureV4 -- sign a request with AWS Signature Version 4
+func setSignatureV4(req *http.Request, payloadHash string) {
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host, any content headers and all the x-amz headers
+	headers := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for header := range req.Header {
+		norm := strings.ToLower(header)
+		if strings.HasPrefix(norm, "x-amz-") || norm == "content-md5" || norm == "content-type" {
+			headers = append(headers, norm)
+			values[norm] = strings.TrimSpace(req.Header.Get(header))
+		}
+	}
+	sort.Strings(headers)
+	var canonicalHeaders bytes.Buffer
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[h] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, v4Escape(k)+"="+v4Escape(v))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalRequest := req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		strings.Join(params, "&") + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		payloadHash
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	mac := hmac.New(sha256.New, v4SigningKey(date, region))
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		access_key, scope, signedHeaders, hex.EncodeToString(mac.Sum(nil))))
+}
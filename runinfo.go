@@ -0,0 +1,147 @@
+// runinfo.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const version = "0.1"
+
+// Version of the layout of the run and end records of -j files
+const runSchema = "hsbench.run/1"
+const endSchema = "hsbench.end/1"
+
+// Seed of the object data and of every random choice of the threads, 0 to
+// pick one
+var seed int64
+
+// The random numbers of every thread, derived from the seed so that a run
+// can be repeated.  Thread n of every stage carries on with the numbers of
+// thread n of the stage before.
+var thread_rands []*rand.Rand
+
+// makeThreadRands -- make sure there are random numbers for threads threads
+func makeThreadRands(threads int) {
+	for n := len(thread_rands); n < threads; n++ {
+		thread_rands = append(thread_rands, rand.New(rand.NewSource(seed+int64(n)+1)))
+	}
+}
+
+func threadRand(n int) *rand.Rand {
+	return thread_rands[n]
+}
+
+// tagFlag -- the name=value pairs of the repeatable -tag flag
+type tagFlag map[string]string
+
+func (t tagFlag) String() string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + t[name]
+	}
+	return strings.Join(names, ",")
+}
+
+func (t tagFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 1 {
+		return fmt.Errorf("must be name=value")
+	}
+	t[v[:i]] = v[i+1:]
+	return nil
+}
+
+var tags = tagFlag{}
+
+// RunInfo -- the first line of a -j file, describing the run the results
+// on the lines after it came from
+type RunInfo struct {
+	Schema    string
+	RunID     string
+	Version   string
+	Start     time.Time
+	Host      string
+	OS        string
+	Kernel    string
+	CPUs      int
+	GoVersion string
+	Tags      map[string]string
+	// The value of every flag, the keys left out, and the stages they
+	// make up
+	Parameters map[string]string
+	Stages     []string
+}
+
+// RunEnd -- the last line of a -j file, written when the run completed or
+// was interrupted
+type RunEnd struct {
+	Schema string
+	RunID  string
+	End    time.Time
+	Status string
+}
+
+var run_info RunInfo
+
+// makeRunInfo -- describe the run, with the values its flags ended up with
+// once the run was set up, i.e. the driver picked for a file:// URL and
+// the address of the mem:// server
+func makeRunInfo(flags *flag.FlagSet) {
+	id := make([]byte, 16)
+	crand.Read(id)
+	host, _ := os.Hostname()
+	kernel, _ := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	run_info = RunInfo{
+		Schema:     runSchema,
+		RunID:      hex.EncodeToString(id),
+		Version:    version,
+		Start:      time.Now(),
+		Host:       host,
+		OS:         runtime.GOOS + "/" + runtime.GOARCH,
+		Kernel:     strings.TrimSpace(string(kernel)),
+		CPUs:       runtime.NumCPU(),
+		GoVersion:  runtime.Version(),
+		Tags:       tags,
+		Parameters: map[string]string{},
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "a", "s", "sse-c-key":
+			return
+		}
+		run_info.Parameters[f.Name] = f.Value.String()
+	})
+	run_info.Parameters["seed"] = fmt.Sprint(seed)
+	for _, st := range plan {
+		run_info.Stages = append(run_info.Stages, st.String())
+	}
+}
+
+// writeRecord -- add a run or end record to the -j file
+func writeRecord(jfile *os.File, record interface{}) {
+	jdata, err := json.Marshal(record)
+	if err != nil {
+		log.Fatal("Error marshaling JSON: ", err)
+	}
+	if _, err = jfile.WriteString(string(jdata) + "\n"); err != nil {
+		log.Fatal("Error writing to JSON file: ", err)
+	}
+}
@@ -0,0 +1,23 @@
+// runinfo_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestRunInfoKeys -- the keys given on the command line aren't recorded
+func TestRunInfoKeys(t *testing.T) {
+	os.Args = []string{"hsbench", "-a", "AKIDSECRET", "-s", "SECRET", "-sse-c-key", "SSECSECRET", "-u", "mem://", "-m", "p", "-n", "1"}
+	makeRunInfo(parseArgs())
+	for _, name := range []string{"a", "s", "sse-c-key"} {
+		if v, ok := run_info.Parameters[name]; ok {
+			t.Errorf("-%s is recorded as %s", name, v)
+		}
+	}
+	if run_info.Parameters["m"] != "p" {
+		t.Errorf("-m is recorded as %s, want p", run_info.Parameters["m"])
+	}
+}
@@ -0,0 +1,330 @@
+// sdk.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// sdkDriver -- the Driver for S3 endpoints, built on aws-sdk-go.  It
+// supports every optional interface.
+type sdkDriver struct {
+	svc *s3.S3
+}
+
+func makeSDKDriver(cfg *aws.Config) *sdkDriver {
+	return &sdkDriver{svc: s3.New(session.New(), cfg)}
+}
+
+func (d *sdkDriver) CreateBucket(ctx context.Context, bucket string) error {
+	_, err := d.svc.CreateBucketWithContext(ctx, &s3.CreateBucketInput{Bucket: &bucket})
+	if err != nil &&
+		!strings.Contains(err.Error(), s3.ErrCodeBucketAlreadyOwnedByYou) &&
+		!strings.Contains(err.Error(), "BucketAlreadyExists") {
+		return err
+	}
+	return nil
+}
+
+func (d *sdkDriver) DeleteBucket(ctx context.Context, bucket string) error {
+	_, err := d.svc.DeleteBucketWithContext(ctx, &s3.DeleteBucketInput{Bucket: &bucket})
+	return err
+}
+
+func (d *sdkDriver) PutObject(ctx context.Context, bucket string, key string, data []byte) (string, error) {
+	r := &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	}
+	ssePut(r)
+	req, out := d.svc.PutObjectRequest(r)
+	req.SetContext(ctx)
+	setPayload(req, r, data)
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.VersionId), nil
+}
+
+func (d *sdkDriver) GetObject(ctx context.Context, bucket string, key string, versionId string) (io.ReadCloser, error) {
+	r := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if versionId != "" {
+		r.VersionId = &versionId
+	}
+	sseGet(r)
+	req, resp := d.svc.GetObjectRequest(r)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (d *sdkDriver) HeadObject(ctx context.Context, bucket string, key string) (int64, error) {
+	r := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	sseHead(r)
+	req, resp := d.svc.HeadObjectRequest(r)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return 0, err
+	}
+	return aws.Int64Value(resp.ContentLength), nil
+}
+
+func (d *sdkDriver) DeleteObject(ctx context.Context, bucket string, key string, versionId string) error {
+	r := &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if versionId != "" {
+		r.VersionId = &versionId
+	}
+	req, _ := d.svc.DeleteObjectRequest(r)
+	req.SetContext(ctx)
+	return req.Send()
+}
+
+func (d *sdkDriver) DeleteObjects(ctx context.Context, bucket string, objects []ObjectId) (int, error) {
+	ids := make([]*s3.ObjectIdentifier, len(objects))
+	for i := range objects {
+		ids[i] = &s3.ObjectIdentifier{Key: aws.String(objects[i].Key)}
+		if objects[i].VersionId != "" {
+			ids[i].VersionId = aws.String(objects[i].VersionId)
+		}
+	}
+	out, err := d.svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: &bucket,
+		Delete: &s3.Delete{
+			Objects: ids,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Quiet responses only list the keys that could not be deleted
+	if len(out.Errors) > 0 {
+		e := out.Errors[0]
+		return len(ids) - len(out.Errors), fmt.Errorf("%d of %d keys not deleted, first %s: %s %s",
+			len(out.Errors), len(ids), aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
+	return len(ids), nil
+}
+
+// optString -- nil for empty strings, so unset options are left out
+func optString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func prefixes(cps []*s3.CommonPrefix) []string {
+	p := make([]string, len(cps))
+	for i, cp := range cps {
+		p[i] = aws.StringValue(cp.Prefix)
+	}
+	return p
+}
+
+func contents(objs []*s3.Object) []ObjectId {
+	ids := make([]ObjectId, len(objs))
+	for i, o := range objs {
+		ids[i] = ObjectId{Key: aws.StringValue(o.Key), Size: aws.Int64Value(o.Size)}
+	}
+	return ids
+}
+
+func (d *sdkDriver) List(ctx context.Context, bucket string, opts ListOptions, page func(ListPage) bool) error {
+	switch {
+	case opts.Versions:
+		in := &s3.ListObjectVersionsInput{
+			Bucket:    &bucket,
+			MaxKeys:   &opts.MaxKeys,
+			Prefix:    optString(opts.Prefix),
+			Delimiter: optString(opts.Delimiter),
+		}
+		return d.svc.ListObjectVersionsPagesWithContext(ctx, in,
+			func(p *s3.ListObjectVersionsOutput, last bool) bool {
+				ids := make([]ObjectId, 0, len(p.Versions)+len(p.DeleteMarkers))
+				for _, v := range p.Versions {
+					ids = append(ids, ObjectId{aws.StringValue(v.Key), aws.StringValue(v.VersionId), aws.Int64Value(v.Size)})
+				}
+				for _, m := range p.DeleteMarkers {
+					ids = append(ids, ObjectId{aws.StringValue(m.Key), aws.StringValue(m.VersionId), 0})
+				}
+				return page(ListPage{ids, prefixes(p.CommonPrefixes)})
+			})
+	case opts.Version == 2:
+		in := &s3.ListObjectsV2Input{
+			Bucket:     &bucket,
+			MaxKeys:    &opts.MaxKeys,
+			Prefix:     optString(opts.Prefix),
+			Delimiter:  optString(opts.Delimiter),
+			StartAfter: optString(opts.StartAfter),
+		}
+		return d.svc.ListObjectsV2PagesWithContext(ctx, in,
+			func(p *s3.ListObjectsV2Output, last bool) bool {
+				return page(ListPage{contents(p.Contents), prefixes(p.CommonPrefixes)})
+			})
+	default:
+		in := &s3.ListObjectsInput{
+			Bucket:    &bucket,
+			MaxKeys:   &opts.MaxKeys,
+			Prefix:    optString(opts.Prefix),
+			Delimiter: optString(opts.Delimiter),
+			Marker:    optString(opts.StartAfter),
+		}
+		return d.svc.ListObjectsPagesWithContext(ctx, in,
+			func(p *s3.ListObjectsOutput, last bool) bool {
+				return page(ListPage{contents(p.Contents), prefixes(p.CommonPrefixes)})
+			})
+	}
+}
+
+// copySource -- return the URL encoded bucket/key used as a copy source
+func copySource(bucket string, key string) string {
+	u := url.URL{Path: bucket + "/" + key}
+	return u.EscapedPath()
+}
+
+// CopyObject -- copy in one request, or in parts of copy_part_size with
+// UploadPartCopy when the objects are larger than that
+func (d *sdkDriver) CopyObject(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, size int64) error {
+	if copy_part_size > 0 && size > copy_part_size {
+		return d.copyObjectParts(ctx, srcBucket, srcKey, dstBucket, dstKey, size)
+	}
+	src := copySource(srcBucket, srcKey)
+	in := &s3.CopyObjectInput{
+		Bucket:     &dstBucket,
+		Key:        &dstKey,
+		CopySource: &src,
+	}
+	if copy_replace_metadata {
+		in.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		in.Metadata = map[string]*string{"hsbench-copy": aws.String("replaced")}
+	}
+	sseCopy(in)
+	_, err := d.svc.CopyObjectWithContext(ctx, in)
+	return err
+}
+
+// copyObjectParts -- copy a source object with UploadPartCopy, one range per part
+func (d *sdkDriver) copyObjectParts(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, size int64) error {
+	src := copySource(srcBucket, srcKey)
+	// Multipart copies never carry over the source metadata, so only set
+	// it explicitly when the user asked for the metadata to be replaced.
+	in := &s3.CreateMultipartUploadInput{
+		Bucket: &dstBucket,
+		Key:    &dstKey,
+	}
+	if copy_replace_metadata {
+		in.Metadata = map[string]*string{"hsbench-copy": aws.String("replaced")}
+	}
+	sseCreateMultipart(in)
+	mpu, err := d.svc.CreateMultipartUploadWithContext(ctx, in)
+	if err != nil {
+		return err
+	}
+	// A failed copy doesn't leave its upload behind.  The abort gets its
+	// own context since ctx may be the one that timed out.
+	abort := func(err error) error {
+		d.AbortUpload(context.Background(), dstBucket, dstKey, aws.StringValue(mpu.UploadId))
+		return err
+	}
+	parts := []*s3.CompletedPart{}
+	for off, part := int64(0), int64(1); off < size; off, part = off+copy_part_size, part+1 {
+		last := off + copy_part_size - 1
+		if last >= size {
+			last = size - 1
+		}
+		pin := &s3.UploadPartCopyInput{
+			Bucket:          &dstBucket,
+			Key:             &dstKey,
+			CopySource:      &src,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", off, last)),
+			PartNumber:      aws.Int64(part),
+			UploadId:        mpu.UploadId,
+		}
+		ssePartCopy(pin)
+		out, err := d.svc.UploadPartCopyWithContext(ctx, pin)
+		if err != nil {
+			return abort(err)
+		}
+		if out.CopyPartResult == nil {
+			return abort(fmt.Errorf("UploadPartCopy of part %d returned no CopyPartResult", part))
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(part)})
+	}
+	_, err = d.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &dstBucket,
+		Key:             &dstKey,
+		UploadId:        mpu.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+func (d *sdkDriver) EnableVersioning(ctx context.Context, bucket string) error {
+	_, err := d.svc.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+		Bucket: &bucket,
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	return err
+}
+
+// IsVersioned -- whether versioning was ever enabled.  Suspended buckets
+// still hold the versions written before.
+func (d *sdkDriver) IsVersioned(ctx context.Context, bucket string) (bool, error) {
+	out, err := d.svc.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{Bucket: &bucket})
+	if err != nil {
+		return false, err
+	}
+	return aws.StringValue(out.Status) != "", nil
+}
+
+func (d *sdkDriver) ListUploads(ctx context.Context, bucket string, prefix string, upload func(key string, uploadId string) bool) error {
+	in := &s3.ListMultipartUploadsInput{
+		Bucket: &bucket,
+		Prefix: optString(prefix),
+	}
+	return d.svc.ListMultipartUploadsPagesWithContext(ctx, in,
+		func(p *s3.ListMultipartUploadsOutput, last bool) bool {
+			for _, u := range p.Uploads {
+				if !upload(aws.StringValue(u.Key), aws.StringValue(u.UploadId)) {
+					return false
+				}
+			}
+			return true
+		})
+}
+
+func (d *sdkDriver) AbortUpload(ctx context.Context, bucket string, key string, uploadId string) error {
+	_, err := d.svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		UploadId: &uploadId,
+	})
+	return err
+}
@@ -0,0 +1,241 @@
+// search.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The -slo limits: the latency in ms the slo_percentile of the requests
+// has to stay under and the fraction of requests allowed to fail, -1 for
+// no limit
+var slo_percentile float64
+var slo_latency, slo_errors float64 = -1, -1
+
+// The parameter -search varies and the range it searches
+var search_param string
+var search_min, search_max float64
+
+// parseSLO -- parse a -slo argument like p99<50ms,errors<0.1%
+func parseSLO(arg string) error {
+	for _, term := range strings.Split(arg, ",") {
+		i := strings.Index(term, "<")
+		if i < 0 {
+			return fmt.Errorf("'%s' must be name<limit", term)
+		}
+		name, limit := term[:i], term[i+1:]
+		switch {
+		case name == "errors":
+			v, err := strconv.ParseFloat(strings.TrimSuffix(limit, "%"), 64)
+			if err != nil || !strings.HasSuffix(limit, "%") || v < 0 || v > 100 {
+				return fmt.Errorf("invalid error limit '%s', must be a percentage", limit)
+			}
+			slo_errors = v / 100
+		case strings.HasPrefix(name, "p"):
+			if slo_latency >= 0 {
+				return fmt.Errorf("only one latency percentile can be given")
+			}
+			p, err := strconv.ParseFloat(name[1:], 64)
+			if err != nil || p <= 0 || p > 100 {
+				return fmt.Errorf("invalid percentile '%s'", name)
+			}
+			d, err := time.ParseDuration(limit)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid latency '%s', must be a duration like 50ms", limit)
+			}
+			slo_percentile = p
+			slo_latency = float64(d) / float64(time.Millisecond)
+		default:
+			return fmt.Errorf("unknown limit '%s', must be pNN or errors", name)
+		}
+	}
+	return nil
+}
+
+// parseSearch -- parse a -search argument like threads=1-256
+func parseSearch(arg string) error {
+	i := strings.Index(arg, "=")
+	if i < 0 {
+		return fmt.Errorf("must be name=min-max")
+	}
+	search_param = arg[:i]
+	if search_param != "threads" && search_param != "rate" {
+		return fmt.Errorf("can't search %s, only threads and rate", search_param)
+	}
+	bounds := strings.SplitN(arg[i+1:], "-", 2)
+	if len(bounds) != 2 {
+		return fmt.Errorf("the range must be min-max")
+	}
+	var err1, err2 error
+	search_min, err1 = strconv.ParseFloat(bounds[0], 64)
+	search_max, err2 = strconv.ParseFloat(bounds[1], 64)
+	if err1 != nil || err2 != nil || search_min < 1 || search_max < search_min {
+		return fmt.Errorf("the range must be min-max with 1 <= min <= max")
+	}
+	if search_param == "threads" {
+		search_min = math.Floor(search_min)
+		search_max = math.Floor(search_max)
+	}
+	lead, trail := planEnds()
+	for _, st := range plan[lead:trail] {
+		if !modeSpecs[st.modes[0]].bucket {
+			return nil
+		}
+	}
+	return fmt.Errorf("the modes have nothing to measure besides the bucket modes")
+}
+
+// searchStep -- the outcome of running the stages with one value
+type searchStep struct {
+	value  float64
+	ops    int
+	secs   float64
+	failed int64
+	lat    float64
+	pass   bool
+	why    []string
+}
+
+func (s *searchStep) iops() float64 {
+	if s.secs == 0 {
+		return 0
+	}
+	return float64(s.ops) / s.secs
+}
+
+func (s *searchStep) point() string {
+	return search_param + "=" + searchValue(s.value)
+}
+
+func (s *searchStep) String() string {
+	res := "PASS"
+	if !s.pass {
+		res = "FAIL (" + strings.Join(s.why, ", ") + ")"
+	}
+	lat := ""
+	if slo_latency >= 0 {
+		lat = fmt.Sprintf(", %g%%: %.1fms", slo_percentile, s.lat)
+	}
+	return fmt.Sprintf("%s: %s, IO/s: %.0f%s, Errors: %.3f%%", s.point(), res, s.iops(), lat, 100*s.errors())
+}
+
+// errors -- the fraction of requests that failed.  Every failed attempt is
+// a slowdown, so there were ops+failed attempts.
+func (s *searchStep) errors() float64 {
+	if s.ops+int(s.failed) == 0 {
+		return 0
+	}
+	return float64(s.failed) / float64(s.ops+int(s.failed))
+}
+
+// add -- count the TOTAL rows of a run of st, failing the step if it fell
+// more than 10% short of the rate of the stage
+func (s *searchStep) add(st *Stage, os []OutputStats) {
+	ops := 0
+	secs := 0.0
+	for _, o := range os {
+		if o.IntervalName != "TOTAL" {
+			continue
+		}
+		ops += o.Ops
+		s.failed += o.Slowdowns
+		// Modes reporting several streams run them at the same time
+		secs = math.Max(secs, o.Seconds)
+		s.lat = math.Max(s.lat, o.sloLat)
+	}
+	s.ops += ops
+	s.secs += secs
+	if st.Rate > 0 && secs > 0 && float64(ops)/secs < 0.9*st.Rate {
+		s.pass = false
+		s.why = append(s.why, fmt.Sprintf("%s at %.0f of %.0f IO/s", st.desc(), float64(ops)/secs, st.Rate))
+	}
+}
+
+// searchValue -- value as it goes into the stages
+func searchValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// runSearch -- look for the highest threads or rate that keeps every
+// measured stage within the -slo limits.  The value doubles from the
+// bottom of the range until it misses them, then the last passing and
+// first failing values are bisected to a thread or 5% of the rate.
+func runSearch(loop int) []OutputStats {
+	lead, trail := planEnds()
+	oStats := runPlan(loop, plan[:lead])
+	steps := make([]*searchStep, 0)
+
+	try := func(v float64) bool {
+		s := &searchStep{value: v, pass: true}
+		sweep_point = s.point()
+		log.Printf("Running Loop %d search point %s", loop, sweep_point)
+		for _, st := range plan[lead:trail] {
+			st = withParam(st, search_param, searchValue(v))
+			for rep := 0; rep < st.Repeat; rep++ {
+				os := runWrapper(loop, st)
+				oStats = append(oStats, os...)
+				s.add(st, os)
+			}
+		}
+		if slo_latency >= 0 && s.lat >= slo_latency {
+			s.pass = false
+			s.why = append(s.why, fmt.Sprintf("%g%% latency", slo_percentile))
+		}
+		if slo_errors >= 0 && s.failed > 0 && s.errors() >= slo_errors {
+			s.pass = false
+			s.why = append(s.why, "errors")
+		}
+		log.Printf("Search step %s", s)
+		steps = append(steps, s)
+		return s.pass
+	}
+
+	var good, bad *searchStep
+	for v := search_min; ; v = math.Min(2*v, search_max) {
+		if !try(v) {
+			bad = steps[len(steps)-1]
+			break
+		}
+		good = steps[len(steps)-1]
+		if v == search_max {
+			break
+		}
+	}
+	for good != nil && bad != nil {
+		precision := 1.0
+		if search_param == "rate" {
+			precision = math.Max(1, 0.05*good.value)
+		}
+		if bad.value-good.value <= precision {
+			break
+		}
+		mid := math.Floor((good.value + bad.value) / 2)
+		if try(mid) {
+			good = steps[len(steps)-1]
+		} else {
+			bad = steps[len(steps)-1]
+		}
+	}
+	sweep_point = ""
+	oStats = append(oStats, runPlan(loop, plan[trail:])...)
+
+	log.Printf("Search trajectory for %s:", sloArg)
+	for _, s := range steps {
+		log.Printf("  %s", s)
+	}
+	switch {
+	case good == nil:
+		log.Printf("Search result: %s already misses %s", steps[0].point(), sloArg)
+	case bad == nil:
+		log.Printf("Search result: %s, IO/s: %.0f, the top of the range still meets %s", good.point(), good.iops(), sloArg)
+	default:
+		log.Printf("Search result: %s, IO/s: %.0f within %s", good.point(), good.iops(), sloArg)
+	}
+	return oStats
+}
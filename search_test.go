@@ -0,0 +1,84 @@
+// search_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSLO(t *testing.T) {
+	valid := []struct {
+		arg                  string
+		percentile, lat, err float64
+	}{
+		{"p99<50ms", 99, 50, -1},
+		{"p99.9<2s,errors<0.5%", 99.9, 2000, 0.005},
+		{"errors<1%", 0, -1, 0.01},
+	}
+	for _, tt := range valid {
+		slo_percentile, slo_latency, slo_errors = 0, -1, -1
+		if err := parseSLO(tt.arg); err != nil {
+			t.Errorf("parseSLO(%s): %v", tt.arg, err)
+			continue
+		}
+		if slo_percentile != tt.percentile || slo_latency != tt.lat || slo_errors != tt.err {
+			t.Errorf("parseSLO(%s) gave p%g<%gms and errors<%g", tt.arg, slo_percentile, slo_latency, slo_errors)
+		}
+	}
+	for _, arg := range []string{"p99", "p0<1ms", "p101<1ms", "p99<0s", "p99<fast", "p99<1ms,p50<1ms",
+		"errors<1", "errors<101%", "errors<-1%", "lat<1ms"} {
+		slo_percentile, slo_latency, slo_errors = 0, -1, -1
+		if err := parseSLO(arg); err == nil {
+			t.Errorf("parseSLO(%s) didn't fail", arg)
+		}
+	}
+	slo_percentile, slo_latency, slo_errors = 0, -1, -1
+}
+
+func TestParseSearch(t *testing.T) {
+	setPlan := func(modes string) {
+		stages, err := parseModes(modes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, st := range stages {
+			st.Threads, st.Size, st.Repeat = 1, "1K", 1
+			if err := st.check(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		plan = stages
+	}
+	defer func() { plan = nil }()
+
+	setPlan("cxipgdcx")
+	valid := []struct {
+		arg      string
+		param    string
+		min, max float64
+	}{
+		{"threads=1-256", "threads", 1, 256},
+		{"threads=1.5-8.9", "threads", 1, 8},
+		{"rate=100-100", "rate", 100, 100},
+	}
+	for _, tt := range valid {
+		if err := parseSearch(tt.arg); err != nil {
+			t.Errorf("parseSearch(%s): %v", tt.arg, err)
+			continue
+		}
+		if search_param != tt.param || search_min != tt.min || search_max != tt.max {
+			t.Errorf("parseSearch(%s) gave %s=%g-%g", tt.arg, search_param, search_min, search_max)
+		}
+	}
+	for _, arg := range []string{"threads", "size=1-2", "threads=8", "threads=0-8", "threads=8-4", "rate=a-b"} {
+		if err := parseSearch(arg); err == nil {
+			t.Errorf("parseSearch(%s) didn't fail", arg)
+		}
+	}
+
+	setPlan("cix")
+	if err := parseSearch("threads=1-8"); err == nil {
+		t.Errorf("parseSearch didn't fail for bucket modes alone")
+	}
+}
@@ -0,0 +1,842 @@
+// server.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The mem:// server keeps everything in memory.  It speaks just enough of
+// the S3 REST API, path style and without checking signatures, for every
+// request hsbench sends.  With mem_discard set it only remembers object
+// sizes and returns zeroes, which makes it a null sink for measuring what
+// the client alone can do.
+var mem_discard bool
+
+type memObject struct {
+	data         []byte
+	size         int64
+	etag         string
+	modified     time.Time
+	versionId    string
+	deleteMarker bool
+}
+
+type memUpload struct {
+	key   string
+	parts map[int]*memObject
+}
+
+type memBucket struct {
+	sync.Mutex
+	// "", "Enabled" or "Suspended"
+	versioning string
+	// Every version of every key, oldest first.  Unversioned buckets keep
+	// a single "null" version.
+	objects map[string][]*memObject
+	uploads map[string]*memUpload
+	// The keys in order, rebuilt by the first listing after a change
+	sorted []string
+	dirty  bool
+}
+
+type memServer struct {
+	sync.RWMutex
+	buckets map[string]*memBucket
+	discard bool
+	// Source of version IDs, upload IDs and ETags
+	seq int64
+}
+
+func makeMemServer(discard bool) *memServer {
+	return &memServer{buckets: map[string]*memBucket{}, discard: discard}
+}
+
+func (s *memServer) nextId() string {
+	return fmt.Sprintf("%016x", atomic.AddInt64(&s.seq, 1))
+}
+
+// startMemServer -- serve a new memServer on a loopback port for -u mem://
+// and return its URL
+func startMemServer(discard bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("FATAL: Unable to start the mem:// server: %v", err)
+	}
+	go http.Serve(l, makeMemServer(discard))
+	return "http://" + l.Addr().String()
+}
+
+// runServe -- "hsbench serve", run the server on its own
+func runServe(args []string) {
+	myflag := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := myflag.String("listen", "127.0.0.1:9000", "Address to listen on")
+	discard := myflag.Bool("discard", false, "Only keep object sizes and return zeroes on GET")
+	myflag.Usage = func() {
+		fmt.Fprintf(myflag.Output(), "\nUSAGE: %s serve [OPTIONS]\n\nOPTIONS:\n", os.Args[0])
+		myflag.PrintDefaults()
+	}
+	if err := myflag.Parse(args); err != nil {
+		os.Exit(1)
+	}
+	log.Printf("Serving an in-memory S3 stand-in on http://%s, discard=%t", *listen, *discard)
+	log.Fatal(http.ListenAndServe(*listen, makeMemServer(*discard)))
+}
+
+// memError -- send an S3 error response
+func memError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(status)
+		return
+	}
+	memXML(w, status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: code, Message: http.StatusText(status), Resource: r.URL.Path})
+}
+
+func memXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body = nil
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+// readChunked -- decode an aws-chunked body into w.  Chunk signatures and
+// trailers are skipped, not checked.
+func readChunked(r *bufio.Reader, w io.Writer) (int64, error) {
+	total := int64(0)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return total, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		n, err := strconv.ParseInt(line, 16, 64)
+		if err != nil {
+			return total, fmt.Errorf("bad chunk size %q", line)
+		}
+		if n == 0 {
+			break
+		}
+		if _, err = io.CopyN(w, r, n); err != nil {
+			return total, err
+		}
+		total += n
+		if _, err = r.Discard(2); err != nil {
+			return total, err
+		}
+	}
+	// Any trailers end with an empty line
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return total, err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return total, nil
+		}
+	}
+}
+
+// readObject -- read a request body into a new object
+func (s *memServer) readObject(r *http.Request) (*memObject, error) {
+	o := &memObject{etag: `"` + s.nextId() + `"`, modified: time.Now().UTC()}
+	var buf bytes.Buffer
+	var w io.Writer = ioutil.Discard
+	if !s.discard {
+		if r.ContentLength > 0 {
+			buf.Grow(int(r.ContentLength))
+		}
+		w = &buf
+	}
+	var err error
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		o.size, err = readChunked(bufio.NewReader(r.Body), w)
+	} else {
+		o.size, err = io.Copy(w, r.Body)
+	}
+	if !s.discard {
+		o.data = buf.Bytes()
+	}
+	return o, err
+}
+
+// zeroes -- what discarded objects read back as
+var zeroes = make([]byte, 64*1024)
+
+func (s *memServer) writeObject(w http.ResponseWriter, o *memObject, versioned bool, body bool) {
+	h := w.Header()
+	h.Set("Content-Length", strconv.FormatInt(o.size, 10))
+	h.Set("ETag", o.etag)
+	h.Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	if versioned {
+		h.Set("X-Amz-Version-Id", o.versionId)
+	}
+	w.WriteHeader(http.StatusOK)
+	if !body {
+		return
+	}
+	if !s.discard {
+		w.Write(o.data)
+		return
+	}
+	for left := o.size; left > 0; {
+		n := int64(len(zeroes))
+		if n > left {
+			n = left
+		}
+		w.Write(zeroes[:n])
+		left -= n
+	}
+}
+
+func (s *memServer) bucket(name string) *memBucket {
+	s.RLock()
+	defer s.RUnlock()
+	return s.buckets[name]
+}
+
+func (s *memServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	name, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, key = path[:i], path[i+1:]
+	}
+	if name == "" {
+		memError(w, r, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	q := r.URL.Query()
+
+	// Bucket creation and deletion are the only calls without a bucket
+	if key == "" && r.Method == "PUT" && !has(q, "versioning") {
+		s.Lock()
+		if s.buckets[name] == nil {
+			s.buckets[name] = &memBucket{objects: map[string][]*memObject{}, uploads: map[string]*memUpload{}}
+		}
+		s.Unlock()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	b := s.bucket(name)
+	if b == nil {
+		memError(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" && r.Method == "DELETE" {
+		s.Lock()
+		b.Lock()
+		empty := len(b.objects) == 0 && len(b.uploads) == 0
+		if empty {
+			delete(s.buckets, name)
+		}
+		b.Unlock()
+		s.Unlock()
+		if !empty {
+			memError(w, r, http.StatusConflict, "BucketNotEmpty")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if key == "" {
+		s.serveBucket(w, r, b, q)
+	} else {
+		s.serveObject(w, r, b, key, q)
+	}
+}
+
+func has(q url.Values, param string) bool {
+	_, ok := q[param]
+	return ok
+}
+
+func (s *memServer) serveBucket(w http.ResponseWriter, r *http.Request, b *memBucket, q url.Values) {
+	switch {
+	case r.Method == "HEAD":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "PUT" && has(q, "versioning"):
+		var in struct{ Status string }
+		if err := xml.NewDecoder(r.Body).Decode(&in); err != nil {
+			memError(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		b.Lock()
+		b.versioning = in.Status
+		b.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET" && has(q, "versioning"):
+		b.Lock()
+		status := b.versioning
+		b.Unlock()
+		memXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"VersioningConfiguration"`
+			Status  string   `xml:",omitempty"`
+		}{Status: status})
+	case r.Method == "GET" && has(q, "versions"):
+		s.listVersions(w, b, q)
+	case r.Method == "GET" && has(q, "uploads"):
+		s.listUploads(w, b, q)
+	case r.Method == "GET":
+		s.listObjects(w, b, q)
+	case r.Method == "POST" && has(q, "delete"):
+		s.deleteObjects(w, r, b)
+	default:
+		memError(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *memServer) serveObject(w http.ResponseWriter, r *http.Request, b *memBucket, key string, q url.Values) {
+	switch {
+	case r.Method == "PUT" && has(q, "uploadId"):
+		s.uploadPart(w, r, b, key, q)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, status, code := s.copySource(r)
+		if src == nil {
+			memError(w, r, status, code)
+			return
+		}
+		o := *src
+		o.etag = `"` + s.nextId() + `"`
+		o.modified = time.Now().UTC()
+		b.Lock()
+		b.put(s, key, &o)
+		b.Unlock()
+		memXML(w, http.StatusOK, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: o.etag, LastModified: o.modified.Format(time.RFC3339)})
+	case r.Method == "PUT":
+		o, err := s.readObject(r)
+		if err != nil {
+			memError(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		b.Lock()
+		b.put(s, key, o)
+		versioned := b.versioning != ""
+		b.Unlock()
+		w.Header().Set("ETag", o.etag)
+		if versioned {
+			w.Header().Set("X-Amz-Version-Id", o.versionId)
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET" || r.Method == "HEAD":
+		b.Lock()
+		o := b.get(key, q.Get("versionId"))
+		versioned := b.versioning != ""
+		b.Unlock()
+		if o == nil {
+			memError(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.writeObject(w, o, versioned, r.Method == "GET")
+	case r.Method == "DELETE" && has(q, "uploadId"):
+		b.Lock()
+		_, ok := b.uploads[q.Get("uploadId")]
+		delete(b.uploads, q.Get("uploadId"))
+		b.Unlock()
+		if !ok {
+			memError(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		b.Lock()
+		b.remove(s, key, q.Get("versionId"))
+		b.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && has(q, "uploads"):
+		id := s.nextId()
+		b.Lock()
+		b.uploads[id] = &memUpload{key: key, parts: map[int]*memObject{}}
+		b.Unlock()
+		memXML(w, http.StatusOK, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: id})
+	case r.Method == "POST" && has(q, "uploadId"):
+		s.completeUpload(w, r, b, key, q.Get("uploadId"))
+	default:
+		memError(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// put -- store a new version of key, replacing the "null" version unless
+// versioning is enabled.  The caller holds the bucket lock.
+func (b *memBucket) put(s *memServer, key string, o *memObject) {
+	versions := b.objects[key]
+	if len(versions) == 0 {
+		b.dirty = true
+	}
+	if b.versioning == "Enabled" {
+		o.versionId = s.nextId()
+	} else {
+		o.versionId = "null"
+		for i, v := range versions {
+			if v.versionId == "null" {
+				versions = append(versions[:i:i], versions[i+1:]...)
+				break
+			}
+		}
+	}
+	b.objects[key] = append(versions, o)
+}
+
+// get -- the latest version of key, or the given version of it
+func (b *memBucket) get(key string, versionId string) *memObject {
+	versions := b.objects[key]
+	if versionId == "" {
+		if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+			return nil
+		}
+		return versions[len(versions)-1]
+	}
+	for _, v := range versions {
+		if v.versionId == versionId && !v.deleteMarker {
+			return v
+		}
+	}
+	return nil
+}
+
+// remove -- delete a version of key, or on versioned buckets without a
+// version ID, hide it behind a delete marker
+func (b *memBucket) remove(s *memServer, key string, versionId string) {
+	versions := b.objects[key]
+	if versionId == "" && b.versioning != "" {
+		if len(versions) > 0 {
+			b.put(s, key, &memObject{deleteMarker: true, modified: time.Now().UTC()})
+		}
+		return
+	}
+	if versionId == "" {
+		versionId = "null"
+	}
+	for i, v := range versions {
+		if v.versionId == versionId {
+			versions = append(versions[:i:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(b.objects, key)
+		b.dirty = true
+	} else {
+		b.objects[key] = versions
+	}
+}
+
+// copySource -- look up the object named by x-amz-copy-source, narrowed to
+// x-amz-copy-source-range if there is one
+func (s *memServer) copySource(r *http.Request) (*memObject, int, string) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, http.StatusBadRequest, "InvalidArgument"
+	}
+	versionId := ""
+	if i := strings.Index(src, "?versionId="); i >= 0 {
+		src, versionId = src[:i], src[i+len("?versionId="):]
+	}
+	src = strings.TrimPrefix(src, "/")
+	i := strings.IndexByte(src, '/')
+	if i < 0 {
+		return nil, http.StatusBadRequest, "InvalidArgument"
+	}
+	b := s.bucket(src[:i])
+	if b == nil {
+		return nil, http.StatusNotFound, "NoSuchBucket"
+	}
+	b.Lock()
+	o := b.get(src[i+1:], versionId)
+	b.Unlock()
+	if o == nil {
+		return nil, http.StatusNotFound, "NoSuchKey"
+	}
+	rng := r.Header.Get("X-Amz-Copy-Source-Range")
+	if rng == "" {
+		return o, 0, ""
+	}
+	var first, last int64
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first > last || last >= o.size {
+		return nil, http.StatusRequestedRangeNotSatisfiable, "InvalidRange"
+	}
+	part := *o
+	part.size = last - first + 1
+	if o.data != nil {
+		part.data = o.data[first : last+1]
+	}
+	return &part, 0, ""
+}
+
+func (s *memServer) uploadPart(w http.ResponseWriter, r *http.Request, b *memBucket, key string, q url.Values) {
+	num, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || num < 1 {
+		memError(w, r, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	var part *memObject
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		src, status, code := s.copySource(r)
+		if src == nil {
+			memError(w, r, status, code)
+			return
+		}
+		copied := *src
+		part = &copied
+		part.etag = `"` + s.nextId() + `"`
+	} else if part, err = s.readObject(r); err != nil {
+		memError(w, r, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	b.Lock()
+	u := b.uploads[q.Get("uploadId")]
+	if u != nil {
+		u.parts[num] = part
+	}
+	b.Unlock()
+	if u == nil {
+		memError(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		memXML(w, http.StatusOK, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{ETag: part.etag, LastModified: time.Now().UTC().Format(time.RFC3339)})
+		return
+	}
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *memServer) completeUpload(w http.ResponseWriter, r *http.Request, b *memBucket, key string, uploadId string) {
+	var in struct {
+		Part []struct{ PartNumber int }
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&in); err != nil {
+		memError(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	u := b.uploads[uploadId]
+	if u == nil || u.key != key {
+		memError(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	o := &memObject{etag: `"` + s.nextId() + `"`, modified: time.Now().UTC()}
+	for _, p := range in.Part {
+		part := u.parts[p.PartNumber]
+		if part == nil {
+			memError(w, r, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		o.size += part.size
+		if !s.discard {
+			o.data = append(o.data, part.data...)
+		}
+	}
+	delete(b.uploads, uploadId)
+	b.put(s, key, o)
+	memXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+		ETag    string
+	}{Key: key, ETag: o.etag})
+}
+
+func (s *memServer) deleteObjects(w http.ResponseWriter, r *http.Request, b *memBucket) {
+	var in struct {
+		Quiet  bool
+		Object []struct {
+			Key       string
+			VersionId string
+		}
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&in); err != nil {
+		memError(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	type deleted struct {
+		Key       string
+		VersionId string `xml:",omitempty"`
+	}
+	out := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []deleted
+	}{}
+	b.Lock()
+	for _, o := range in.Object {
+		b.remove(s, o.Key, o.VersionId)
+		if !in.Quiet {
+			out.Deleted = append(out.Deleted, deleted{o.Key, o.VersionId})
+		}
+	}
+	b.Unlock()
+	memXML(w, http.StatusOK, out)
+}
+
+// keys -- every key in order.  The caller holds the bucket lock.
+func (b *memBucket) keys() []string {
+	if b.dirty || b.sorted == nil {
+		b.sorted = make([]string, 0, len(b.objects))
+		for k := range b.objects {
+			b.sorted = append(b.sorted, k)
+		}
+		sort.Strings(b.sorted)
+		b.dirty = false
+	}
+	return b.sorted
+}
+
+// walk -- visit the keys of one listing page in order, starting after
+// marker.  Keys sharing a prefix up to the delimiter are folded into one
+// common prefix.  visit returns whether the key counts toward maxKeys.
+// Returns the common prefixes, the last key or prefix and whether the
+// listing was cut short.  The caller holds the bucket lock.
+func (b *memBucket) walk(prefix string, delimiter string, marker string, maxKeys int, visit func(key string) bool) ([]string, string, bool) {
+	if maxKeys <= 0 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+	keys := b.keys()
+	start := prefix
+	if marker > start {
+		start = marker
+	}
+	var prefixes []string
+	count := 0
+	last := ""
+	for i := sort.SearchStrings(keys, start); i < len(keys); i++ {
+		key := keys[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if key <= marker {
+			continue
+		}
+		// A marker ending in the delimiter is a common prefix already listed
+		if delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(key, marker) {
+			continue
+		}
+		cp := ""
+		if delimiter != "" {
+			if j := strings.Index(key[len(prefix):], delimiter); j >= 0 {
+				cp = key[:len(prefix)+j+len(delimiter)]
+			}
+		}
+		if cp != "" && cp == last {
+			continue
+		}
+		if count == maxKeys {
+			return prefixes, last, true
+		}
+		if cp != "" {
+			prefixes = append(prefixes, cp)
+			last = cp
+			count++
+		} else if visit(key) {
+			last = key
+			count++
+		}
+	}
+	return prefixes, last, false
+}
+
+type memContents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type memPrefix struct {
+	Prefix string
+}
+
+func commonPrefixes(prefixes []string) []memPrefix {
+	cps := make([]memPrefix, len(prefixes))
+	for i, p := range prefixes {
+		cps[i].Prefix = p
+	}
+	return cps
+}
+
+func (s *memServer) listObjects(w http.ResponseWriter, b *memBucket, q url.Values) {
+	v2 := q.Get("list-type") == "2"
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	marker := q.Get("marker")
+	if v2 {
+		marker = q.Get("start-after")
+		if token := q.Get("continuation-token"); token > marker {
+			marker = token
+		}
+	}
+	maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+
+	var contents []memContents
+	b.Lock()
+	prefixes, last, truncated := b.walk(prefix, delimiter, marker, maxKeys, func(key string) bool {
+		o := b.get(key, "")
+		if o == nil {
+			// Only delete markers left
+			return false
+		}
+		contents = append(contents, memContents{key, o.modified.Format(time.RFC3339), o.etag, o.size, "STANDARD"})
+		return true
+	})
+	b.Unlock()
+
+	next := ""
+	if truncated {
+		next = last
+	}
+	if v2 {
+		memXML(w, http.StatusOK, struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			Prefix                string
+			Delimiter             string `xml:",omitempty"`
+			StartAfter            string `xml:",omitempty"`
+			ContinuationToken     string `xml:",omitempty"`
+			NextContinuationToken string `xml:",omitempty"`
+			KeyCount              int
+			MaxKeys               int
+			IsTruncated           bool
+			Contents              []memContents
+			CommonPrefixes        []memPrefix
+		}{Prefix: prefix, Delimiter: delimiter, StartAfter: q.Get("start-after"),
+			ContinuationToken: q.Get("continuation-token"), NextContinuationToken: next,
+			KeyCount: len(contents) + len(prefixes), MaxKeys: maxKeys, IsTruncated: truncated,
+			Contents: contents, CommonPrefixes: commonPrefixes(prefixes)})
+		return
+	}
+	memXML(w, http.StatusOK, struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Prefix         string
+		Delimiter      string `xml:",omitempty"`
+		Marker         string
+		NextMarker     string `xml:",omitempty"`
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []memContents
+		CommonPrefixes []memPrefix
+	}{Prefix: prefix, Delimiter: delimiter, Marker: marker, NextMarker: next, MaxKeys: maxKeys,
+		IsTruncated: truncated, Contents: contents, CommonPrefixes: commonPrefixes(prefixes)})
+}
+
+// listVersions -- pages always end on a key boundary, so only key markers
+// are handed out
+func (s *memServer) listVersions(w http.ResponseWriter, b *memBucket, q url.Values) {
+	type version struct {
+		Key          string
+		VersionId    string
+		IsLatest     bool
+		LastModified string
+		ETag         string `xml:",omitempty"`
+		Size         int64
+		StorageClass string `xml:",omitempty"`
+	}
+	type marker struct {
+		Key          string
+		VersionId    string
+		IsLatest     bool
+		LastModified string
+	}
+	out := struct {
+		XMLName        xml.Name `xml:"ListVersionsResult"`
+		Prefix         string
+		Delimiter      string `xml:",omitempty"`
+		KeyMarker      string
+		NextKeyMarker  string `xml:",omitempty"`
+		MaxKeys        int
+		IsTruncated    bool
+		Version        []version
+		DeleteMarker   []marker
+		CommonPrefixes []memPrefix
+	}{Prefix: q.Get("prefix"), Delimiter: q.Get("delimiter"), KeyMarker: q.Get("key-marker")}
+	out.MaxKeys, _ = strconv.Atoi(q.Get("max-keys"))
+
+	b.Lock()
+	prefixes, last, truncated := b.walk(out.Prefix, out.Delimiter, out.KeyMarker, out.MaxKeys, func(key string) bool {
+		versions := b.objects[key]
+		// Newest first, like S3
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			latest := i == len(versions)-1
+			if v.deleteMarker {
+				out.DeleteMarker = append(out.DeleteMarker, marker{key, v.versionId, latest, v.modified.Format(time.RFC3339)})
+			} else {
+				out.Version = append(out.Version, version{key, v.versionId, latest, v.modified.Format(time.RFC3339), v.etag, v.size, "STANDARD"})
+			}
+		}
+		return true
+	})
+	b.Unlock()
+	out.CommonPrefixes = commonPrefixes(prefixes)
+	out.IsTruncated = truncated
+	if truncated {
+		out.NextKeyMarker = last
+	}
+	memXML(w, http.StatusOK, out)
+}
+
+// listUploads -- every upload in one page
+func (s *memServer) listUploads(w http.ResponseWriter, b *memBucket, q url.Values) {
+	type upload struct {
+		Key      string
+		UploadId string
+	}
+	out := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Prefix      string
+		IsTruncated bool
+		Upload      []upload
+	}{Prefix: q.Get("prefix")}
+	b.Lock()
+	for id, u := range b.uploads {
+		if strings.HasPrefix(u.key, out.Prefix) {
+			out.Upload = append(out.Upload, upload{u.key, id})
+		}
+	}
+	b.Unlock()
+	sort.Slice(out.Upload, func(i, j int) bool { return out.Upload[i].Key < out.Upload[j].Key })
+	memXML(w, http.StatusOK, out)
+}
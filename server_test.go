@@ -0,0 +1,49 @@
+// server_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+// TestMemTotals -- run a PUT and a GET stage against the mem:// server and
+// check the TOTAL rows against the ops sent.  The stages are paced so that
+// they span a few intervals, which can't hold more ops than the TOTAL row
+// since the last partial one isn't reported.
+func TestMemTotals(t *testing.T) {
+	const objects, size = 100, 4096
+	os.Args = []string{"hsbench", "-a", "a", "-s", "s", "-u", "mem://", "-m", "ip[rate=500]g[rate=500]", "-n", "100", "-t", "4", "-z", "4K", "-ri", "0.1"}
+	parseArgs()
+	url_host = startMemServer(false)
+	backend = makeDriver()
+	initData()
+	makeBuckets()
+
+	totals := map[string]OutputStats{}
+	intervalOps := map[string]int{}
+	for _, o := range runPlan(0, plan) {
+		if o.IntervalName == "TOTAL" {
+			totals[o.Mode] = o
+		} else {
+			intervalOps[o.Mode] += o.Ops
+		}
+	}
+	for _, mode := range []string{"PUT", "GET"} {
+		o, ok := totals[mode]
+		if !ok {
+			t.Fatalf("No TOTAL row for %s", mode)
+		}
+		if o.Ops != objects || o.Slowdowns != 0 {
+			t.Errorf("%s: %d ops and %d slowdowns, want %d ops and none", mode, o.Ops, o.Slowdowns, objects)
+		}
+		if bytes := o.Mbps * o.Seconds * 1024 * 1024; math.Abs(bytes-objects*size) > 1 {
+			t.Errorf("%s: %.0f bytes, want %d", mode, bytes, objects*size)
+		}
+		if intervalOps[mode] == 0 || intervalOps[mode] > o.Ops {
+			t.Errorf("%s: the intervals have %d ops, the TOTAL row %d", mode, intervalOps[mode], o.Ops)
+		}
+	}
+}
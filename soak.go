@@ -0,0 +1,232 @@
+// soak.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Prefix of the files a soak test streams its results to, empty unless
+// soaking, the seconds each of its summaries covers, and the size at which
+// the interval files are rotated
+var soak_prefix, soakRotateArg string
+var soak_period float64
+var soak_rotate int64
+
+// A period whose IO/s fell or whose 99% latency rose by more than this
+// fraction over the first one counts as degraded
+const soakDegraded = 0.1
+
+// soakFile -- a CSV file the rows of a soak test are appended to as they
+// come in.  A rotated file moves on to the next number once it grew past
+// soak_rotate bytes.
+type soakFile struct {
+	mu     sync.Mutex
+	name   string
+	rotate bool
+	num    int
+	file   *os.File
+	w      *csv.Writer
+	// Set once the run is over, so that late rows don't open it again
+	closed bool
+}
+
+var soakIntervals, soakSummaries *soakFile
+
+func makeSoakFiles() {
+	soakIntervals = &soakFile{name: soak_prefix + "-intervals-%03d.csv", rotate: true}
+	soakSummaries = &soakFile{name: soak_prefix + "-summary.csv"}
+}
+
+// closeSoakFiles -- close the soak files, if this is a soak test
+func closeSoakFiles() {
+	if soakIntervals != nil {
+		soakIntervals.close()
+		soakSummaries.close()
+	}
+}
+
+func (f *soakFile) open() {
+	name := f.name
+	if f.rotate {
+		name = fmt.Sprintf(f.name, f.num)
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Fatalf("Could not open soak file %s: %v", name, err)
+	}
+	log.Printf("Writing soak results to %s", name)
+	f.file = file
+	f.w = csv.NewWriter(file)
+	(&OutputStats{}).csv_header(f.w)
+}
+
+func (f *soakFile) write(o *OutputStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	if f.file == nil {
+		f.open()
+	}
+	o.csv(f.w)
+	f.w.Flush()
+	if err := f.w.Error(); err != nil {
+		log.Fatal("Error writing to soak file: ", err)
+	}
+	if !f.rotate {
+		return
+	}
+	if size, err := f.file.Seek(0, io.SeekCurrent); err == nil && size >= soak_rotate {
+		f.file.Close()
+		f.file = nil
+		f.num++
+	}
+}
+
+func (f *soakFile) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.closed = true
+}
+
+// soakStats -- what a stream of a soak test keeps in place of its
+// intervals: the totals of the intervals written out so far and the
+// summaries of the periods.  The intervals of every thread are dropped
+// once they are written out, and the latencies go into histograms, so the
+// memory used stays the same however long the test runs.
+type soakStats struct {
+	mu sync.Mutex
+	// Every interval before done was written out, and so were those in
+	// emitted, which can complete out of order
+	done    int64
+	emitted map[int64]bool
+	total   IntervalStats
+	// The period being summarized and the intervals it has so far
+	period          IntervalStats
+	periodIntervals int64
+	summaries       []OutputStats
+}
+
+func makeSoakStats(loop int, mode string) *soakStats {
+	return &soakStats{
+		emitted: map[int64]bool{},
+		total:   IntervalStats{loop, "TOTAL", mode, 0, 0, 0, 0, []int64{}, makeLatHist()},
+		period:  IntervalStats{loop, "", mode, 0, 0, 0, 0, []int64{}, makeLatHist()},
+	}
+}
+
+// updateIntervals -- move a thread on to its current interval like
+// ThreadStats.updateIntervals does, dropping the intervals that were
+// written out
+func (sk *soakStats) updateIntervals(stats *Stats, thread_num int) int64 {
+	ts := &stats.threadStats[thread_num]
+	if ts.curInterval < 0 || ts.start+stats.intervalNano*(ts.curInterval+1) >= time.Now().UnixNano() {
+		return ts.curInterval
+	}
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	cur := ts.updateIntervals(stats.loop, stats.mode, stats.intervalNano)
+	if drop := sk.done - ts.base; drop > 0 {
+		ts.intervals = append([]IntervalStats(nil), ts.intervals[drop:]...)
+		ts.base += drop
+	}
+	return cur
+}
+
+// interval -- write out interval i, which every thread is done with, and
+// add it to the totals and the period
+func (sk *soakStats) interval(stats *Stats, i int64) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	parts := make([]*IntervalStats, stats.threads)
+	for t := range parts {
+		parts[t] = stats.threadStats[t].interval(i)
+	}
+	is := mergeIntervals(stats.loop, strconv.FormatInt(i, 10), stats.mode, parts, stats.intervalNano)
+	o := is.makeOutputStats()
+	o.log()
+	soakIntervals.write(&o)
+
+	sk.total = mergeIntervals(stats.loop, "TOTAL", stats.mode, []*IntervalStats{&sk.total, &is}, 0)
+	sk.period = mergeIntervals(stats.loop, "", stats.mode, []*IntervalStats{&sk.period, &is}, 0)
+	sk.periodIntervals++
+	if float64(sk.periodIntervals*stats.intervalNano) >= soak_period*1000000000 {
+		sk.summarize(stats)
+	}
+
+	for _, p := range parts {
+		*p = IntervalStats{}
+	}
+	stats.intervalCompletions.Delete(i)
+	sk.emitted[i] = true
+	for sk.emitted[sk.done] {
+		delete(sk.emitted, sk.done)
+		sk.done++
+	}
+}
+
+// summarize -- log and write out the summary of the period and start the
+// next one
+func (sk *soakStats) summarize(stats *Stats) {
+	sk.period.name = fmt.Sprintf("P%d", len(sk.summaries)+1)
+	sk.period.intervalNano = sk.periodIntervals * stats.intervalNano
+	o := sk.period.makeOutputStats()
+	o.log()
+	soakSummaries.write(&o)
+	writeResult(&o)
+	sk.summaries = append(sk.summaries, o)
+	sk.period = IntervalStats{stats.loop, "", stats.mode, 0, 0, 0, 0, []int64{}, makeLatHist()}
+	sk.periodIntervals = 0
+}
+
+// change -- the relative change from a to b as a percentage
+func change(a float64, b float64) string {
+	if a == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*(b-a)/a)
+}
+
+// finish -- summarize what is left of the last period, report how the
+// last full period compares to the first and return the summaries
+func (sk *soakStats) finish(stats *Stats) []OutputStats {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	full := len(sk.summaries)
+	if sk.periodIntervals > 0 {
+		sk.summarize(stats)
+	}
+	if full < 2 {
+		if len(sk.summaries) > 0 {
+			log.Printf("Soak report for %s: fewer than 2 full periods of %gs, nothing to compare", stats.mode, soak_period)
+		}
+		return sk.summaries
+	}
+	a, b := sk.summaries[0], sk.summaries[full-1]
+	verdict := "steady"
+	if b.Iops < (1-soakDegraded)*a.Iops || b.NinetyNineLat > (1+soakDegraded)*a.NinetyNineLat {
+		verdict = "DEGRADED"
+	}
+	log.Printf("Soak report for %s, %s against %s: %s, IO/s: %.0f -> %.0f (%s), Lat(ms): [ avg: %.1f -> %.1f (%s), 99%%: %.1f -> %.1f (%s), max: %.1f -> %.1f (%s) ], Slowdowns: %d -> %d",
+		stats.mode, b.IntervalName, a.IntervalName, verdict,
+		a.Iops, b.Iops, change(a.Iops, b.Iops),
+		a.AvgLat, b.AvgLat, change(a.AvgLat, b.AvgLat),
+		a.NinetyNineLat, b.NinetyNineLat, change(a.NinetyNineLat, b.NinetyNineLat),
+		a.MaxLat, b.MaxLat, change(a.MaxLat, b.MaxLat),
+		a.Slowdowns, b.Slowdowns)
+	return sk.summaries
+}
@@ -0,0 +1,94 @@
+// sse.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Server side encryption settings, see -sse.  The SDK base64 encodes the
+// customer key and computes its MD5 itself, so sse_c_key holds raw bytes.
+var sse_mode, sse_kms_key_id, sse_c_key string
+
+// The encoded customer key and its MD5, as sent by the raw driver
+var sse_c_key_b64, sse_c_key_md5 string
+
+const sseCustomerAlgorithm = "AES256"
+
+func ssePut(in *s3.PutObjectInput) {
+	switch sse_mode {
+	case s3.ServerSideEncryptionAes256:
+		in.ServerSideEncryption = aws.String(sse_mode)
+	case s3.ServerSideEncryptionAwsKms:
+		in.ServerSideEncryption = aws.String(sse_mode)
+		if sse_kms_key_id != "" {
+			in.SSEKMSKeyId = &sse_kms_key_id
+		}
+	case "SSE-C":
+		in.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.SSECustomerKey = &sse_c_key
+	}
+}
+
+// SSE-S3 and SSE-KMS objects are decrypted transparently on reads, only
+// customer keys have to be sent again.
+
+func sseGet(in *s3.GetObjectInput) {
+	if sse_mode == "SSE-C" {
+		in.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.SSECustomerKey = &sse_c_key
+	}
+}
+
+func sseHead(in *s3.HeadObjectInput) {
+	if sse_mode == "SSE-C" {
+		in.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.SSECustomerKey = &sse_c_key
+	}
+}
+
+// Copies read an encrypted source and write an encrypted destination, both
+// with the same settings.
+
+func sseCopy(in *s3.CopyObjectInput) {
+	switch sse_mode {
+	case s3.ServerSideEncryptionAes256:
+		in.ServerSideEncryption = aws.String(sse_mode)
+	case s3.ServerSideEncryptionAwsKms:
+		in.ServerSideEncryption = aws.String(sse_mode)
+		if sse_kms_key_id != "" {
+			in.SSEKMSKeyId = &sse_kms_key_id
+		}
+	case "SSE-C":
+		in.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.SSECustomerKey = &sse_c_key
+		in.CopySourceSSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.CopySourceSSECustomerKey = &sse_c_key
+	}
+}
+
+func sseCreateMultipart(in *s3.CreateMultipartUploadInput) {
+	switch sse_mode {
+	case s3.ServerSideEncryptionAes256:
+		in.ServerSideEncryption = aws.String(sse_mode)
+	case s3.ServerSideEncryptionAwsKms:
+		in.ServerSideEncryption = aws.String(sse_mode)
+		if sse_kms_key_id != "" {
+			in.SSEKMSKeyId = &sse_kms_key_id
+		}
+	case "SSE-C":
+		in.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.SSECustomerKey = &sse_c_key
+	}
+}
+
+func ssePartCopy(in *s3.UploadPartCopyInput) {
+	if sse_mode == "SSE-C" {
+		in.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.SSECustomerKey = &sse_c_key
+		in.CopySourceSSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		in.CopySourceSSECustomerKey = &sse_c_key
+	}
+}
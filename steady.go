@@ -0,0 +1,127 @@
+// steady.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+// Number of intervals the IO/s and average latency of every stream have to
+// stay within steady_cv of their mean for the object modes to be steady, 0
+// to not look for a steady state
+var steady_intervals int
+var steady_cv float64
+
+// End a mode as soon as it is steady, and keep a mode that isn't steady by
+// the end of its duration going for up to steady_max seconds
+var steady_stop bool
+var steady_max float64
+
+// Set to end the object modes of the running stage early
+var stop_stage int32
+
+// steadyWatch -- follows the intervals of the streams of a stage as they
+// complete, looking for the first window of steady_intervals intervals in
+// which every stream is steady.  The window grows for as long as the
+// stage stays steady.
+type steadyWatch struct {
+	streams []*Stats
+	// The next interval to look at
+	next int64
+	// IO/s and average latency of every interval, for each stream
+	iops [][]float64
+	lat  [][]float64
+	// The steady window, first is -1 until one was found
+	first, last int64
+	broken      bool
+}
+
+func makeSteadyWatch(streams []*Stats) *steadyWatch {
+	return &steadyWatch{
+		streams: streams,
+		iops:    make([][]float64, len(streams)),
+		lat:     make([][]float64, len(streams)),
+		first:   -1,
+		last:    -1,
+	}
+}
+
+// cv -- the coefficient of variation of the last n values
+func cv(values []float64, n int) float64 {
+	values = values[len(values)-n:]
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(n)
+	if mean == 0 {
+		return 0
+	}
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance/float64(n)) / mean
+}
+
+// poll -- look at the intervals that completed since the last call, and
+// return whether a steady window was found
+func (w *steadyWatch) poll() bool {
+	for !w.broken {
+		rows := make([]OutputStats, len(w.streams))
+		for n, s := range w.streams {
+			o, ok := s.makeOutputStats(w.next)
+			if !ok {
+				return w.first >= 0
+			}
+			rows[n] = o
+		}
+		steady := w.next+1 >= int64(steady_intervals)
+		for n, o := range rows {
+			w.iops[n] = append(w.iops[n], o.Iops)
+			w.lat[n] = append(w.lat[n], o.AvgLat)
+			if steady && (cv(w.iops[n], steady_intervals) > steady_cv || cv(w.lat[n], steady_intervals) > steady_cv) {
+				steady = false
+			}
+		}
+		switch {
+		case steady && w.first < 0:
+			w.first = w.next + 1 - int64(steady_intervals)
+			w.last = w.next
+			log.Printf("Steady state reached over intervals %d to %d", w.first, w.last)
+		case steady:
+			w.last = w.next
+		case w.first >= 0:
+			w.broken = true
+		}
+		w.next++
+	}
+	return true
+}
+
+// makeSteadyStats -- the stats of every stream over the steady window
+func (w *steadyWatch) makeSteadyStats() []OutputStats {
+	os := make([]OutputStats, 0)
+	if w.first < 0 {
+		return os
+	}
+	for _, s := range w.streams {
+		parts := make([]*IntervalStats, 0)
+		for t := 0; t < s.threads; t++ {
+			for i := w.first; i <= w.last; i++ {
+				parts = append(parts, s.threadStats[t].interval(i))
+			}
+		}
+		is := mergeIntervals(s.loop, "STEADY", s.mode, parts, (w.last-w.first+1)*s.intervalNano)
+		os = append(os, is.makeOutputStats())
+	}
+	return os
+}
+
+// stopStage -- end the object modes of the running stage
+func stopStage() {
+	atomic.StoreInt32(&stop_stage, 1)
+}
@@ -0,0 +1,112 @@
+// sweep.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The parameter and values of -sweep, and the point being run as
+// name=value for the Sweep column of the results
+var sweep_param, sweep_point string
+var sweep_values []string
+
+// parseSweep -- split a -sweep argument like threads=1,2,4 and check the
+// values
+func parseSweep(arg string) error {
+	i := strings.Index(arg, "=")
+	if i < 0 {
+		return fmt.Errorf("must be name=value,value,...")
+	}
+	sweep_param = arg[:i]
+	sweep_values = strings.Split(arg[i+1:], ",")
+	for _, v := range sweep_values {
+		var err error
+		switch sweep_param {
+		case "threads", "buckets":
+			var n int64
+			if n, err = strconv.ParseInt(v, 10, 64); err == nil && n < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+			if err == nil && sweep_param == "buckets" && n < 2 && copy_dest == "cross" {
+				err = fmt.Errorf("-cd cross needs at least 2 buckets")
+			}
+		case "size":
+			var d sizeDist
+			if d, err = parseSizeDist(v); err == nil && d.max() > object_size {
+				object_size = d.max()
+			}
+		case "rate":
+			var r float64
+			if r, err = strconv.ParseFloat(v, 64); err == nil && r <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		default:
+			return fmt.Errorf("can't sweep %s, only threads, size, buckets and rate", sweep_param)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s': %v", sweep_param, v, err)
+		}
+	}
+	return nil
+}
+
+// planEnds -- the number of bucket setup (c, x and i) stages at the start
+// of the plan and the index of the bucket teardown (c and x) stages at its
+// end.  A plan of nothing but setup and teardown has neither.
+func planEnds() (int, int) {
+	lead := 0
+	trail := len(plan)
+	for lead < len(plan) && strings.ContainsRune("cxi", plan[lead].modes[0]) {
+		lead++
+	}
+	for trail > lead && strings.ContainsRune("cx", plan[trail-1].modes[0]) {
+		trail--
+	}
+	if lead == trail {
+		return 0, len(plan)
+	}
+	return lead, trail
+}
+
+// withParam -- a copy of st with the threads, size or rate set to value.
+// Bucket stages are returned as they are, so that the setup and teardown
+// of the buckets aren't throttled or sized like the object modes.
+func withParam(st *Stage, param string, value string) *Stage {
+	if modeSpecs[st.modes[0]].bucket {
+		return st
+	}
+	p := *st
+	switch param {
+	case "threads":
+		p.Threads, _ = strconv.Atoi(value)
+	case "size":
+		p.Size = value
+		p.sizes, _ = parseSizeDist(value)
+	case "rate":
+		p.Rate, _ = strconv.ParseFloat(value, 64)
+	}
+	return &p
+}
+
+// sweepStages -- the stages to run for one point of the sweep.  Unless
+// the number of buckets changes, the bucket setup at the start of the plan
+// only runs for the first point and the teardown at the end only for the
+// last, so the buckets and whatever the plan leaves in them carry over.
+func sweepStages(value string, first bool, last bool) []*Stage {
+	lead, trail := 0, len(plan)
+	if sweep_param != "buckets" {
+		lead, trail = planEnds()
+	}
+	stages := make([]*Stage, 0, len(plan))
+	for i, st := range plan {
+		if (i < lead && !first) || (i >= trail && !last) {
+			continue
+		}
+		stages = append(stages, withParam(st, sweep_param, value))
+	}
+	return stages
+}
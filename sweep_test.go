@@ -0,0 +1,31 @@
+// sweep_test.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"testing"
+)
+
+// TestWithParam -- sweeps and searches leave the bucket stages alone
+func TestWithParam(t *testing.T) {
+	stages, err := parseModes("ipx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range stages {
+		st.inherit(&Stage{Threads: 1, Size: "1K", Rate: -1, Repeat: 1})
+		if err := st.check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct{ param, value string }{{"threads", "8"}, {"rate", "100"}, {"size", "4K"}} {
+		for _, st := range stages {
+			p := withParam(st, tt.param, tt.value)
+			changed := p.Threads != st.Threads || p.Rate != st.Rate || p.Size != st.Size
+			if bucket := modeSpecs[st.modes[0]].bucket; changed == bucket {
+				t.Errorf("%s=%s changed %s to %s", tt.param, tt.value, st, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// versions.go
+// Copyright (c) 2019 Red Hat Inc.
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+)
+
+// The version IDs written by the version put test, keyed by object number.
+// Stages with key ranges and mixes can have several threads on the same
+// object number, so every entry has its own lock.
+var object_versions sync.Map
+
+// resetVersions -- forget the version IDs written so far, which a bucket
+// clear purges
+func resetVersions() {
+	object_versions.Range(func(k, v interface{}) bool {
+		object_versions.Delete(k)
+		return true
+	})
+}
+
+// keyVersions -- the version IDs of one key
+type keyVersions struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+// loadVersions -- the version IDs of object objnum, nil if none were
+// written unless create is set
+func loadVersions(objnum int64, create bool) *keyVersions {
+	if v, ok := object_versions.Load(objnum); ok {
+		return v.(*keyVersions)
+	}
+	if !create {
+		return nil
+	}
+	v, _ := object_versions.LoadOrStore(objnum, &keyVersions{})
+	return v.(*keyVersions)
+}
+
+func (kv *keyVersions) add(id string) {
+	kv.mu.Lock()
+	kv.ids = append(kv.ids, id)
+	kv.mu.Unlock()
+}
+
+// pick -- a random version ID, empty if there are none
+func (kv *keyVersions) pick(rnd *rand.Rand) string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if len(kv.ids) == 0 {
+		return ""
+	}
+	return kv.ids[rnd.Intn(len(kv.ids))]
+}
+
+// take -- remove every version ID for the caller to delete, so no other
+// thread deletes them as well
+func (kv *keyVersions) take() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	ids := kv.ids
+	kv.ids = nil
+	return ids
+}
+
+// restore -- hand back the version IDs a delete didn't get to
+func (kv *keyVersions) restore(ids []string) {
+	kv.mu.Lock()
+	kv.ids = append(ids, kv.ids...)
+	kv.mu.Unlock()
+}
+
+func opVersionPut(oc *opContext, objnum int64) bool {
+	bucket := buckets[objnum%bucket_count]
+	// Overwrite the same key to stack up the versions
+	key := keygen.key(objnum)
+	kv := loadVersions(objnum, true)
+	size := oc.size(objnum)
+	for v := 0; v < versions_per_key; v++ {
+		oc.begin(bucket)
+		var id string
+		err := oc.try(0, func() (err error) {
+			id, err = backend.PutObject(oc.ctx, bucket, key, object_data[:size])
+			return err
+		})
+		if err != nil {
+			oc.fail(0, err)
+			log.Printf("version upload err: %v", err)
+			break
+		}
+		oc.done(0, size)
+		if id == "" {
+			log.Printf("No version ID returned for %s, is versioning enabled on %s?", key, bucket)
+			continue
+		}
+		kv.add(id)
+	}
+	return true
+}
+
+func opVersionGet(oc *opContext, objnum int64) bool {
+	kv := loadVersions(objnum, false)
+	if kv == nil {
+		return true
+	}
+	versionId := kv.pick(oc.rnd)
+	if versionId == "" {
+		return true
+	}
+	bucket := buckets[objnum%bucket_count]
+	key := keygen.key(objnum)
+	oc.begin(bucket)
+	var n int64
+	err := oc.try(0, func() error {
+		body, err := backend.GetObject(oc.ctx, bucket, key, versionId)
+		if err != nil {
+			return err
+		}
+		oc.stop()
+		n, err = drainBody(body)
+		return err
+	})
+	if err != nil {
+		oc.fail(0, err)
+		log.Printf("version download err: %v", err)
+		return true
+	}
+	oc.done(0, n)
+	return true
+}
+
+func opVersionDelete(oc *opContext, objnum int64) bool {
+	// Permanently remove every version this run wrote for the key
+	bucket := buckets[objnum%bucket_count]
+	key := keygen.key(objnum)
+	kv := loadVersions(objnum, false)
+	if kv == nil {
+		return true
+	}
+	ids := kv.take()
+	for len(ids) > 0 {
+		oc.begin(bucket)
+		err := oc.try(0, func() error {
+			return backend.DeleteObject(oc.ctx, bucket, key, ids[0])
+		})
+		if err != nil {
+			oc.fail(0, err)
+			log.Printf("version delete err: %v", err)
+			break
+		}
+		oc.done(0, oc.size(objnum))
+		ids = ids[1:]
+	}
+	if len(ids) > 0 {
+		kv.restore(ids)
+	}
+	return true
+}
+
+func opVersionList(oc *opContext, job int64) bool {
+	err := listPages(oc, buckets[job%bucket_count], ListOptions{
+		Prefix:    listPrefix(oc.rnd),
+		Delimiter: list_delimiter,
+		MaxKeys:   max_keys,
+		Versions:  true,
+	})
+	if err != nil {
+		log.Printf("version list err: %v", err)
+		return false
+	}
+	return true
+}